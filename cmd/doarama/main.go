@@ -1,34 +1,240 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"log"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"sort"
 	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
 
 	"github.com/twpayne/go-doarama"
+	"github.com/twpayne/go-doarama/doaramacache"
 	"github.com/twpayne/go-doarama/doaramacli"
 	"github.com/urfave/cli"
 
 	_ "github.com/mattn/go-sqlite3"
 )
 
-func activityCreateOne(ctx context.Context, client *doarama.Client, filename string, activityInfo *doarama.ActivityInfo) (*doarama.Activity, error) {
-	gpsTrack, err := os.Open(filename)
+// A transformFunc transforms samples before they are uploaded.
+type transformFunc func([]doarama.Sample) []doarama.Sample
+
+func newTransform(c *cli.Context) (transformFunc, error) {
+	timeOffset := doaramacli.TimeOffset(c)
+	filters, err := doaramacli.Filters(c)
+	if err != nil {
+		return nil, err
+	}
+	if timeOffset == 0 && len(filters) == 0 {
+		return nil, nil
+	}
+	return func(samples []doarama.Sample) []doarama.Sample {
+		if timeOffset != 0 {
+			samples = doarama.Shift(samples, timeOffset)
+		}
+		return filters.Apply(samples)
+	}, nil
+}
+
+// A bytesReadCloser is a bytes.Reader with a Close method that does nothing.
+type bytesReadCloser struct {
+	*bytes.Reader
+}
+
+// Close implements io.Closer.
+func (bytesReadCloser) Close() error {
+	return nil
+}
+
+// newUpload returns a doarama.Upload of filename, transformed by transform.
+// The upload keeps the whole of filename so that progress bars can tell apart
+// files with the same name in different directories.
+func newUpload(filename string, activityInfo *doarama.ActivityInfo, transform transformFunc) doarama.Upload {
+	return doarama.Upload{
+		Filename:     filename,
+		ActivityInfo: activityInfo,
+		Open: func() (io.ReadCloser, error) {
+			if transform == nil {
+				return os.Open(filename)
+			}
+			samples, err := readSamples(filename)
+			if err != nil {
+				return nil, err
+			}
+			var b bytes.Buffer
+			if err := doarama.WriteSamples(filename, &b, transform(samples)); err != nil {
+				return nil, err
+			}
+			return bytesReadCloser{bytes.NewReader(b.Bytes())}, nil
+		},
+	}
+}
+
+// A progressCreator marks each activity as finished in its progress bars
+// once it is created.
+type progressCreator struct {
+	ac   doaramacache.ActivityCreator
+	vc   doaramacache.VisualisationCreator
+	bars *doaramacli.ProgressBars
+}
+
+// CreateActivityWithInfo implements doarama.ActivityWithInfoCreator.
+func (p progressCreator) CreateActivityWithInfo(ctx context.Context, filename string, gpsTrack io.Reader, activityInfo *doarama.ActivityInfo) (*doarama.Activity, error) {
+	defer p.bars.Finish(filename)
+	return p.ac.CreateActivityWithInfo(ctx, filename, gpsTrack, activityInfo)
+}
+
+// CreateOrReuseActivityWithInfo implements doarama.ReusingActivityCreator.
+func (p progressCreator) CreateOrReuseActivityWithInfo(ctx context.Context, filename string, gpsTrack io.Reader, activityInfo *doarama.ActivityInfo) (*doarama.Activity, bool, error) {
+	defer p.bars.Finish(filename)
+	if rac, ok := p.ac.(doarama.ReusingActivityCreator); ok {
+		return rac.CreateOrReuseActivityWithInfo(ctx, filename, gpsTrack, activityInfo)
+	}
+	activity, err := p.ac.CreateActivityWithInfo(ctx, filename, gpsTrack, activityInfo)
+	return activity, activity != nil, err
+}
+
+// CreateVisualisation implements doarama.ResourceCreator.
+func (p progressCreator) CreateVisualisation(ctx context.Context, activities []*doarama.Activity) (*doarama.Visualisation, error) {
+	return p.vc.CreateVisualisation(ctx, activities)
+}
+
+// DeleteActivity implements doarama.ResourceCreator.
+func (p progressCreator) DeleteActivity(ctx context.Context, activity *doarama.Activity) error {
+	return p.ac.DeleteActivity(ctx, activity)
+}
+
+// newUploads returns the uploads of the files in args.
+func newUploads(args []string, activityInfo *doarama.ActivityInfo, transform transformFunc) []doarama.Upload {
+	uploads := make([]doarama.Upload, len(args))
+	for i, arg := range args {
+		uploads[i] = newUpload(arg, activityInfo, transform)
+	}
+	return uploads
+}
+
+// interruptContext returns a context that is cancelled when the process
+// receives an interrupt.
+func interruptContext() (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, os.Interrupt)
+	go func() {
+		select {
+		case <-ch:
+			cancel()
+		case <-ctx.Done():
+		}
+		signal.Stop(ch)
+	}()
+	return ctx, cancel
+}
+
+// createActivities creates activities from the files in args with ac, showing
+// progress in bars.
+func createActivities(ctx context.Context, c *cli.Context, ac doaramacache.ActivityCreator, bars *doaramacli.ProgressBars, activityInfo *doarama.ActivityInfo, transform transformFunc) ([]*doarama.Activity, error) {
+	uploads := newUploads(c.Args(), activityInfo, transform)
+	addProgress(bars, c.Args())
+	activities, err := doarama.CreateActivities(ctx, progressCreator{ac: ac, bars: bars}, uploads, c.Int("jobs"))
+	bars.Close()
+	return activities, err
+}
+
+// newUploadClient returns a new authenticated client that reports upload
+// progress to bars.
+func newUploadClient(c *cli.Context, bars *doaramacli.ProgressBars) (*doarama.Client, error) {
+	options, err := doaramacli.NewAuthenticatedDoaramaOptions(c)
 	if err != nil {
 		return nil, err
 	}
-	defer gpsTrack.Close()
-	return client.CreateActivityWithInfo(ctx, filepath.Base(filename), gpsTrack, activityInfo)
+	if bars != nil {
+		options = append(options, doarama.Progress(bars.Update))
+	}
+	return doarama.NewClient(options...), nil
+}
+
+// addProgress adds the files in args to bars.
+func addProgress(bars *doaramacli.ProgressBars, args []string) {
+	for _, arg := range args {
+		size := int64(-1)
+		if fi, err := os.Stat(arg); err == nil {
+			size = fi.Size()
+		}
+		bars.Add(arg, size)
+	}
+}
+
+// activityRecord returns the output record of the activity created from
+// file, or of the error creating it.
+func activityRecord(file string, a *doarama.Activity, err error) *doaramacli.Record {
+	if err != nil {
+		return &doaramacli.Record{Type: "activity", File: file, Err: err}
+	}
+	return &doaramacli.Record{
+		Type:   "activity",
+		File:   file,
+		Fields: []doaramacli.Field{{Name: "ActivityId", Value: a.ID}},
+		Text:   fmt.Sprintf("ActivityId: %d", a.ID),
+	}
+}
+
+// visualisationRecord returns the output record of v with URL options vuo.
+func visualisationRecord(v *doarama.Visualisation, vuo *doarama.VisualisationURLOptions) *doaramacli.Record {
+	u := v.URL(vuo).String()
+	return &doaramacli.Record{
+		Type: "visualisation",
+		Fields: []doaramacli.Field{
+			{Name: "VisualisationKey", Value: v.Key},
+			{Name: "VisualisationURL", Value: u},
+		},
+		Text: fmt.Sprintf("VisualisationKey: %s\nVisualisationURL: %s", v.Key, u),
+	}
+}
+
+// errorRecords returns the output records of err, with one record per
+// tracklog in files that failed to upload and one per activity that could
+// not be rolled back.
+func errorRecords(err error, files []string) []*doaramacli.Record {
+	switch err := err.(type) {
+	case *doarama.ErrRollback:
+		records := errorRecords(err.Err, files)
+		for _, a := range err.Leftovers {
+			records = append(records, &doaramacli.Record{
+				Type:   "activity",
+				Fields: []doaramacli.Field{{Name: "ActivityId", Value: a.ID}},
+				Err:    fmt.Errorf("activity %d: rollback failed", a.ID),
+			})
+		}
+		return records
+	case doarama.ErrUploads:
+		records := make([]*doaramacli.Record, len(err))
+		for i, errUpload := range err {
+			records[i] = activityRecord(files[errUpload.Index], nil, errUpload)
+		}
+		return records
+	default:
+		return []*doaramacli.Record{{Type: "error", Err: err}}
+	}
 }
 
 func activityCreate(c *cli.Context) error {
 	ctx := context.Background()
-	client, err := doaramacli.NewAuthenticatedDoaramaClient(c)
+	out, err := doaramacli.NewOutput(c)
+	if err != nil {
+		return err
+	}
+	bars := doaramacli.NewProgressBars()
+	defer bars.Close()
+	client, err := newUploadClient(c, bars)
 	if err != nil {
 		return err
 	}
@@ -40,49 +246,412 @@ func activityCreate(c *cli.Context) error {
 	activityInfo := &doarama.ActivityInfo{
 		TypeID: activityType.ID,
 	}
-	for _, arg := range c.Args() {
-		a, err := activityCreateOne(ctx, client, arg, activityInfo)
+	transform, err := newTransform(c)
+	if err != nil {
+		return err
+	}
+	ac, err := doaramacli.NewActivityCreator(c, client)
+	if err != nil {
+		return err
+	}
+	defer ac.Close()
+	activities, err := createActivities(ctx, c, ac, bars, activityInfo, transform)
+	errs := make(map[int]error)
+	if errUploads, ok := err.(doarama.ErrUploads); ok {
+		for _, errUpload := range errUploads {
+			errs[errUpload.Index] = errUpload
+		}
+	} else if err != nil {
+		return err
+	}
+	for i, a := range activities {
+		if err := out.Write(activityRecord(c.Args()[i], a, errs[i])); err != nil {
+			return err
+		}
+	}
+	return out.Err()
+}
+
+func parseActivityIDs(args []string) ([]int, error) {
+	var ids []int
+	for _, arg := range args {
+		id64, err := strconv.ParseInt(arg, 10, 0)
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, int(id64))
+	}
+	return ids, nil
+}
+
+func openCache(c *cli.Context, client *doarama.Client) (doaramacache.ActivityCreator, doaramacache.Manager, error) {
+	ac, err := doaramacli.NewActivityCreator(c, client)
+	if err != nil {
+		return nil, nil, err
+	}
+	m, ok := ac.(doaramacache.Manager)
+	if !ok {
+		ac.Close()
+		return nil, nil, errors.New("activity cache disabled")
+	}
+	return ac, m, nil
+}
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return t.Format(time.RFC3339)
+}
+
+// notCachedRecord returns the output record of an activity that is not
+// cached.
+func notCachedRecord(id int) *doaramacli.Record {
+	return &doaramacli.Record{
+		Type:   "cache-entry",
+		Fields: []doaramacli.Field{{Name: "ActivityId", Value: id}},
+		Err:    fmt.Errorf("%d: not cached", id),
+	}
+}
+
+// evictedRecord returns the output record of an activity evicted from the
+// cache.
+func evictedRecord(id int) *doaramacli.Record {
+	return &doaramacli.Record{
+		Type: "cache-entry",
+		Fields: []doaramacli.Field{
+			{Name: "ActivityId", Value: id},
+			{Name: "Evicted", Value: true},
+		},
+		Text: fmt.Sprintf("Evicted: %d", id),
+	}
+}
+
+func cacheDelete(c *cli.Context) error {
+	ctx := context.Background()
+	out, err := doaramacli.NewOutput(c)
+	if err != nil {
+		return err
+	}
+	client, err := doaramacli.NewAuthenticatedDoaramaClient(c)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	ac, m, err := openCache(c, client)
+	if err != nil {
+		return err
+	}
+	defer ac.Close()
+	ids, err := parseActivityIDs(c.Args())
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		e, err := m.Entry(ctx, id)
 		if err != nil {
-			log.Print(err)
+			return err
+		}
+		if e == nil {
+			if err := out.Write(notCachedRecord(id)); err != nil {
+				return err
+			}
 			continue
 		}
-		fmt.Printf("ActivityId: %d\n", a.ID)
+		if err := m.DeleteEntry(ctx, e); err != nil {
+			return err
+		}
+		if err := out.Write(&doaramacli.Record{
+			Type: "cache-entry",
+			Fields: []doaramacli.Field{
+				{Name: "ActivityId", Value: id},
+				{Name: "Deleted", Value: true},
+			},
+		}); err != nil {
+			return err
+		}
+	}
+	return out.Err()
+}
+
+func cacheExport(c *cli.Context) error {
+	ctx := context.Background()
+	client := doaramacli.NewDoaramaClient(c)
+	defer client.Close()
+	ac, m, err := openCache(c, client)
+	if err != nil {
+		return err
+	}
+	defer ac.Close()
+	entries, err := m.Entries(ctx)
+	if err != nil {
+		return err
+	}
+	w := os.Stdout
+	if len(c.Args()) > 0 {
+		if w, err = os.Create(c.Args()[0]); err != nil {
+			return err
+		}
+	}
+	e := json.NewEncoder(w)
+	e.SetIndent("", "  ")
+	if err := e.Encode(entries); err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
+
+func cacheImportOne(ctx context.Context, m doaramacache.Manager, filename string) error {
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	var entries []*doaramacache.Entry
+	if err := json.NewDecoder(f).Decode(&entries); err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if err := m.PutEntry(ctx, e); err != nil {
+			return err
+		}
 	}
 	return nil
 }
 
-func activityDelete(c *cli.Context) error {
+func cacheImport(c *cli.Context) error {
+	ctx := context.Background()
+	client := doaramacli.NewDoaramaClient(c)
+	defer client.Close()
+	ac, m, err := openCache(c, client)
+	if err != nil {
+		return err
+	}
+	defer ac.Close()
+	for _, arg := range c.Args() {
+		if err := cacheImportOne(ctx, m, arg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func cacheList(c *cli.Context) error {
 	ctx := context.Background()
+	out, err := doaramacli.NewOutput(c)
+	if err != nil {
+		return err
+	}
+	client := doaramacli.NewDoaramaClient(c)
+	defer client.Close()
+	ac, m, err := openCache(c, client)
+	if err != nil {
+		return err
+	}
+	defer ac.Close()
+	entries, err := m.Entries(ctx)
+	if err != nil {
+		return err
+	}
+	// Align the text of every record, with the header before the first.
+	var b bytes.Buffer
+	w := tabwriter.NewWriter(&b, 0, 8, 1, ' ', 0)
+	fmt.Fprintln(w, "ActivityId\tGPSTrackSHA256\tActivityInfoSHA256\tFilename\tCreated")
+	for _, e := range entries {
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\n", e.ActivityID, e.GPSTrackSHA256, e.ActivityInfoSHA256, e.Filename, formatTime(e.Created))
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	lines := strings.Split(strings.TrimSuffix(b.String(), "\n"), "\n")
+	for i, e := range entries {
+		text := lines[i+1]
+		if i == 0 {
+			text = lines[0] + "\n" + text
+		}
+		if err := out.Write(&doaramacli.Record{
+			Type: "cache-entry",
+			Fields: []doaramacli.Field{
+				{Name: "ActivityId", Value: e.ActivityID},
+				{Name: "GpsTrackSha256", Value: e.GPSTrackSHA256},
+				{Name: "ActivityInfoSha256", Value: e.ActivityInfoSHA256},
+				{Name: "Filename", Value: e.Filename},
+				{Name: "Created", Value: formatTime(e.Created)},
+				{Name: "ApiUrl", Value: e.APIURL},
+				{Name: "ApiName", Value: e.APIName},
+				{Name: "User", Value: e.User},
+			},
+			Text: text,
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func cachePrune(c *cli.Context) error {
+	ctx := context.Background()
+	out, err := doaramacli.NewOutput(c)
+	if err != nil {
+		return err
+	}
 	client, err := doaramacli.NewAuthenticatedDoaramaClient(c)
 	if err != nil {
 		return err
 	}
 	defer client.Close()
-	var ids []int
-	for _, arg := range c.Args() {
-		id64, err := strconv.ParseInt(arg, 10, 0)
-		if err != nil {
+	ac, m, err := openCache(c, client)
+	if err != nil {
+		return err
+	}
+	defer ac.Close()
+	entries, err := m.Entries(ctx)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	olderThan := c.Duration("older-than")
+	for _, e := range entries {
+		expired := !e.Expires.IsZero() && !now.Before(e.Expires)
+		old := olderThan != 0 && !e.Created.IsZero() && !e.Created.After(now.Add(-olderThan))
+		if !expired && !old {
+			continue
+		}
+		if err := m.DeleteEntry(ctx, e); err != nil {
 			return err
 		}
-		ids = append(ids, int(id64))
+		if err := out.Write(evictedRecord(e.ActivityID)); err != nil {
+			return err
+		}
+	}
+	v, ok := ac.(doaramacache.Verifier)
+	if !ok {
+		return nil
+	}
+	evicted, err := v.Verify(ctx)
+	for _, id := range evicted {
+		if err := out.Write(evictedRecord(id)); err != nil {
+			return err
+		}
+	}
+	return err
+}
+
+func cacheShow(c *cli.Context) error {
+	ctx := context.Background()
+	out, err := doaramacli.NewOutput(c)
+	if err != nil {
+		return err
+	}
+	client, err := doaramacli.NewAuthenticatedDoaramaClient(c)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	ac, m, err := openCache(c, client)
+	if err != nil {
+		return err
+	}
+	defer ac.Close()
+	ids, err := parseActivityIDs(c.Args())
+	if err != nil {
+		return err
 	}
 	for _, id := range ids {
-		a := client.Activity(id)
-		if err := a.Delete(ctx); err != nil {
-			log.Print(err)
+		e, err := m.Entry(ctx, id)
+		if err != nil {
+			return err
+		}
+		if e == nil {
+			if err := out.Write(notCachedRecord(id)); err != nil {
+				return err
+			}
 			continue
 		}
+		if err := out.Write(&doaramacli.Record{
+			Type: "cache-entry",
+			Fields: []doaramacli.Field{
+				{Name: "ActivityId", Value: e.ActivityID},
+				{Name: "GpsTrackSha256", Value: e.GPSTrackSHA256},
+				{Name: "ActivityInfoSha256", Value: e.ActivityInfoSHA256},
+				{Name: "Filename", Value: e.Filename},
+				{Name: "Size", Value: e.Size},
+				{Name: "Created", Value: formatTime(e.Created)},
+				{Name: "ApiUrl", Value: e.APIURL},
+				{Name: "ApiName", Value: e.APIName},
+				{Name: "User", Value: e.User},
+				{Name: "Expires", Value: formatTime(e.Expires)},
+			},
+			Text: strings.Join([]string{
+				fmt.Sprintf("ActivityId: %d", e.ActivityID),
+				fmt.Sprintf("GPSTrackSHA256: %s", e.GPSTrackSHA256),
+				fmt.Sprintf("ActivityInfoSHA256: %s", e.ActivityInfoSHA256),
+				fmt.Sprintf("Filename: %s", e.Filename),
+				fmt.Sprintf("Size: %d", e.Size),
+				fmt.Sprintf("Created: %s", formatTime(e.Created)),
+				fmt.Sprintf("APIURL: %s", e.APIURL),
+				fmt.Sprintf("APIName: %s", e.APIName),
+				fmt.Sprintf("User: %s", e.User),
+				fmt.Sprintf("Expires: %s", formatTime(e.Expires)),
+			}, "\n"),
+		}); err != nil {
+			return err
+		}
 	}
-	return nil
+	return out.Err()
 }
 
-func create(c *cli.Context) error {
+func activityDelete(c *cli.Context) error {
 	ctx := context.Background()
+	out, err := doaramacli.NewOutput(c)
+	if err != nil {
+		return err
+	}
 	client, err := doaramacli.NewAuthenticatedDoaramaClient(c)
 	if err != nil {
 		return err
 	}
 	defer client.Close()
+	ac, err := doaramacli.NewActivityCreator(c, client)
+	if err != nil {
+		return err
+	}
+	defer ac.Close()
+	ids, err := parseActivityIDs(c.Args())
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		r := &doaramacli.Record{
+			Type:   "activity",
+			Fields: []doaramacli.Field{{Name: "ActivityId", Value: id}},
+			Err:    ac.DeleteActivity(ctx, client.Activity(id)),
+		}
+		if r.Err == nil {
+			r.Fields = append(r.Fields, doaramacli.Field{Name: "Deleted", Value: true})
+		}
+		if err := out.Write(r); err != nil {
+			return err
+		}
+	}
+	return out.Err()
+}
+
+func create(c *cli.Context) error {
+	ctx, cancel := interruptContext()
+	defer cancel()
+	out, err := doaramacli.NewOutput(c)
+	if err != nil {
+		return err
+	}
+	bars := doaramacli.NewProgressBars()
+	defer bars.Close()
+	client, err := newUploadClient(c, bars)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
 	activityType, err := doarama.DefaultActivityTypes.Find(doaramacli.ActivityType(c))
 	if err != nil {
 		return err
@@ -90,35 +659,312 @@ func create(c *cli.Context) error {
 	activityInfo := &doarama.ActivityInfo{
 		TypeID: activityType.ID,
 	}
-	var as []*doarama.Activity
-	for _, arg := range c.Args() {
-		var a *doarama.Activity
-		a, err = activityCreateOne(ctx, client, arg, activityInfo)
-		if err != nil {
-			break
-		}
-		fmt.Printf("ActivityId: %d\n", a.ID)
-		as = append(as, a)
+	transform, err := newTransform(c)
+	if err != nil {
+		return err
 	}
+	ac, err := doaramacli.NewActivityCreator(c, client)
 	if err != nil {
-		for _, a := range as {
-			a.Delete(ctx)
-		}
 		return err
 	}
-	if len(as) == 0 {
+	defer ac.Close()
+	if len(c.Args()) == 0 {
 		return errors.New("no activities specified")
 	}
-	v, err := client.CreateVisualisation(ctx, as)
+	groups, err := groupArgs(c, transform)
 	if err != nil {
 		return err
 	}
-	fmt.Printf("VisualisationKey: %s\n", v.Key)
+	rc := progressCreator{
+		ac:   ac,
+		vc:   doaramacli.VisualisationCreator(ac, client),
+		bars: bars,
+	}
+	addProgress(bars, c.Args())
+	var files []string
+	uploadGroups := make([][]doarama.Upload, len(groups))
+	for j, group := range groups {
+		for _, i := range group {
+			files = append(files, c.Args()[i])
+			uploadGroups[j] = append(uploadGroups[j], newUpload(c.Args()[i], activityInfo, transform))
+		}
+	}
+	vs, groupActivities, err := doarama.CreateVisualisationsFromTracks(ctx, rc, uploadGroups, c.Int("jobs"))
+	bars.Close()
+	if err != nil {
+		return out.Fail(err, errorRecords(err, files)...)
+	}
 	vuo := doaramacli.NewVisualisationURLOptions(c)
-	fmt.Printf("VisualisationURL: %s\n", v.URL(vuo))
+	for j, group := range groups {
+		for k, a := range groupActivities[j] {
+			if err := out.Write(activityRecord(c.Args()[group[k]], a, nil)); err != nil {
+				return err
+			}
+		}
+		if err := out.Write(visualisationRecord(vs[j], groupURLOptions(vuo, group))); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// groupArgs returns the indexes of the tracklogs in c.Args() grouped
+// according to the --group-by flag.
+func groupArgs(c *cli.Context, transform transformFunc) ([][]int, error) {
+	switch groupBy := c.String("group-by"); groupBy {
+	case "", "none":
+		group := make([]int, len(c.Args()))
+		for i := range group {
+			group[i] = i
+		}
+		return [][]int{group}, nil
+	case "overlap":
+		tracks := make([][]doarama.Sample, len(c.Args()))
+		for i, arg := range c.Args() {
+			samples, err := readSamples(arg)
+			if err != nil {
+				return nil, err
+			}
+			if transform != nil {
+				samples = transform(samples)
+			}
+			tracks[i] = samples
+		}
+		return doarama.GroupByOverlap(tracks, nil), nil
+	default:
+		return nil, fmt.Errorf("%s: unknown grouping", groupBy)
+	}
+}
+
+// groupURLOptions returns a copy of vuo with only the names and avatars of
+// the tracklogs in group.
+func groupURLOptions(vuo *doarama.VisualisationURLOptions, group []int) *doarama.VisualisationURLOptions {
+	result := *vuo
+	pick := func(ss []string) []string {
+		if len(ss) == 0 {
+			return ss
+		}
+		picked := make([]string, len(group))
+		for i, j := range group {
+			if j < len(ss) {
+				picked[i] = ss[j]
+			}
+		}
+		return picked
+	}
+	result.Names = pick(vuo.Names)
+	result.Avatars = pick(vuo.Avatars)
+	return &result
+}
+
+// configKeyArg returns the configuration key in the first argument of c.
+func configKeyArg(c *cli.Context) (string, error) {
+	key := c.Args().First()
+	if !doaramacli.IsConfigKey(key) {
+		return "", fmt.Errorf("%s: unknown key, valid keys are %s", key, strings.Join(doaramacli.ConfigKeys, ", "))
+	}
+	return key, nil
+}
+
+// configRecord returns the output record of key and value.
+func configRecord(key, value string) *doaramacli.Record {
+	return &doaramacli.Record{
+		Type: "config",
+		Fields: []doaramacli.Field{
+			{Name: "Key", Value: key},
+			{Name: "Value", Value: value},
+		},
+		Text: fmt.Sprintf("%s = %s", key, value),
+	}
+}
+
+func configGet(c *cli.Context) error {
+	out, err := doaramacli.NewOutput(c)
+	if err != nil {
+		return err
+	}
+	if len(c.Args()) != 1 {
+		return errors.New("exactly one key must be specified")
+	}
+	key, err := configKeyArg(c)
+	if err != nil {
+		return err
+	}
+	config, err := doaramacli.ReadConfig(c.GlobalString("config"))
+	if err != nil {
+		return err
+	}
+	value, ok := config.Profiles[c.GlobalString("profile")][key]
+	if !ok {
+		return fmt.Errorf("%s: not set", key)
+	}
+	r := configRecord(key, value)
+	r.Text = value
+	return out.Write(r)
+}
+
+func configList(c *cli.Context) error {
+	out, err := doaramacli.NewOutput(c)
+	if err != nil {
+		return err
+	}
+	config, err := doaramacli.ReadConfig(c.GlobalString("config"))
+	if err != nil {
+		return err
+	}
+	profile := config.Profiles[c.GlobalString("profile")]
+	for _, key := range doaramacli.ConfigKeys {
+		value, ok := profile[key]
+		if !ok {
+			continue
+		}
+		if key == "apikey" || key == "userkey" {
+			value = "********"
+		}
+		if err := out.Write(configRecord(key, value)); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
+func configSet(c *cli.Context) error {
+	if len(c.Args()) != 2 {
+		return errors.New("exactly one key and one value must be specified")
+	}
+	key, err := configKeyArg(c)
+	if err != nil {
+		return err
+	}
+	filename := c.GlobalString("config")
+	config, err := doaramacli.ReadConfig(filename)
+	if err != nil {
+		return err
+	}
+	if config.Profiles == nil {
+		config.Profiles = make(map[string]doaramacli.Profile)
+	}
+	name := c.GlobalString("profile")
+	profile, ok := config.Profiles[name]
+	if !ok {
+		profile = make(doaramacli.Profile)
+		config.Profiles[name] = profile
+	}
+	if value := c.Args().Get(1); value != "" {
+		if err := doaramacli.CheckConfigValue(key, value); err != nil {
+			return err
+		}
+		profile[key] = value
+	} else {
+		delete(profile, key)
+	}
+	return config.Write(filename)
+}
+
+func readSamples(filename string) ([]doarama.Sample, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return doarama.ReadSamples(filename, f)
+}
+
+func writeSamples(filename string, samples []doarama.Sample) error {
+	f, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	if err := doarama.WriteSamples(filename, f, samples); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func convert(c *cli.Context) error {
+	if len(c.Args()) != 2 {
+		return errors.New("exactly one input and one output tracklog must be specified")
+	}
+	samples, err := readSamples(c.Args()[0])
+	if err != nil {
+		return err
+	}
+	transform, err := newTransform(c)
+	if err != nil {
+		return err
+	}
+	if transform != nil {
+		samples = transform(samples)
+	}
+	return writeSamples(c.Args()[1], samples)
+}
+
+func merge(c *cli.Context) error {
+	out, err := doaramacli.NewOutput(c)
+	if err != nil {
+		return err
+	}
+	if len(c.Args()) == 0 {
+		return errors.New("no tracklogs specified")
+	}
+	var tracks [][]doarama.Sample
+	for _, arg := range c.Args() {
+		samples, err := readSamples(arg)
+		if err != nil {
+			return err
+		}
+		tracks = append(tracks, samples)
+	}
+	options := &doarama.MergeOptions{
+		Tolerance: c.Duration("tolerance"),
+		MaxGap:    c.Duration("maxgap"),
+	}
+	if altitudeSource := c.Int("altitudesource"); altitudeSource >= 0 {
+		options.AltitudeSource = &altitudeSource
+	}
+	samples := doarama.Merge(tracks, options)
+	transform, err := newTransform(c)
+	if err != nil {
+		return err
+	}
+	if transform != nil {
+		samples = transform(samples)
+	}
+	if filename := c.String("write"); filename != "" {
+		return writeSamples(filename, samples)
+	}
+	ctx := context.Background()
+	client, err := doaramacli.NewAuthenticatedDoaramaClient(c)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	activityType, err := doarama.DefaultActivityTypes.Find(doaramacli.ActivityType(c))
+	if err != nil {
+		return err
+	}
+	activityInfo := &doarama.ActivityInfo{
+		TypeID: activityType.ID,
+	}
+	var b bytes.Buffer
+	if err := doarama.WriteGPX(&b, samples); err != nil {
+		return err
+	}
+	ac, err := doaramacli.NewActivityCreator(c, client)
+	if err != nil {
+		return err
+	}
+	defer ac.Close()
+	base := filepath.Base(c.Args()[0])
+	filename := strings.TrimSuffix(base, filepath.Ext(base)) + ".gpx"
+	a, err := ac.CreateActivityWithInfo(ctx, filename, &b, activityInfo)
+	if err != nil {
+		return out.Fail(err, activityRecord(filename, nil, err))
+	}
+	return out.Write(activityRecord(filename, a, nil))
+}
+
 type byName doarama.ActivityTypes
 
 func (ats byName) Len() int           { return len(ats) }
@@ -127,7 +973,15 @@ func (ats byName) Swap(i, j int)      { ats[i], ats[j] = ats[j], ats[i] }
 
 func queryActivityTypes(c *cli.Context) error {
 	ctx := context.Background()
-	client := doaramacli.NewDoaramaClient(c)
+	out, err := doaramacli.NewOutput(c)
+	if err != nil {
+		return err
+	}
+	options, err := doaramacli.NewDoaramaOptions(c)
+	if err != nil {
+		return err
+	}
+	client := doarama.NewClient(options...)
 	defer client.Close()
 	ats, err := client.ActivityTypes(ctx)
 	if err != nil {
@@ -135,13 +989,26 @@ func queryActivityTypes(c *cli.Context) error {
 	}
 	sort.Sort(byName(ats))
 	for _, at := range ats {
-		fmt.Printf("%s: %d\n", at.Name, at.ID)
+		if err := out.Write(&doaramacli.Record{
+			Type: "activity-type",
+			Fields: []doaramacli.Field{
+				{Name: "Name", Value: at.Name},
+				{Name: "Id", Value: at.ID},
+			},
+			Text: fmt.Sprintf("%s: %d", at.Name, at.ID),
+		}); err != nil {
+			return err
+		}
 	}
 	return nil
 }
 
 func visualisationCreate(c *cli.Context) error {
 	ctx := context.Background()
+	out, err := doaramacli.NewOutput(c)
+	if err != nil {
+		return err
+	}
 	client, err := doaramacli.NewAuthenticatedDoaramaClient(c)
 	if err != nil {
 		return err
@@ -157,20 +1024,118 @@ func visualisationCreate(c *cli.Context) error {
 		a := client.Activity(int(id64))
 		as = append(as, a)
 	}
-	v, err := client.CreateVisualisation(ctx, as)
+	ac, err := doaramacli.NewActivityCreator(c, client)
 	if err != nil {
 		return err
 	}
-	fmt.Printf("VisualisationKey: %s\n", v.Key)
-	return nil
+	defer ac.Close()
+	v, err := doaramacli.VisualisationCreator(ac, client).CreateVisualisation(ctx, as)
+	if err != nil {
+		return out.Fail(err)
+	}
+	return out.Write(&doaramacli.Record{
+		Type:   "visualisation",
+		Fields: []doaramacli.Field{{Name: "VisualisationKey", Value: v.Key}},
+		Text:   fmt.Sprintf("VisualisationKey: %s", v.Key),
+	})
+}
+
+func visualisationAdd(c *cli.Context) error {
+	return visualisationActivities(c, doaramacache.VisualisationManager.AddActivities)
+}
+
+func visualisationRemove(c *cli.Context) error {
+	return visualisationActivities(c, doaramacache.VisualisationManager.RemoveActivities)
+}
+
+// visualisationActivities calls f with the visualisation key and activity ids
+// in c's arguments.
+func visualisationActivities(c *cli.Context, f func(doaramacache.VisualisationManager, context.Context, *doarama.Visualisation, []*doarama.Activity) error) error {
+	ctx := context.Background()
+	out, err := doaramacli.NewOutput(c)
+	if err != nil {
+		return err
+	}
+	if len(c.Args()) < 2 {
+		return errors.New("a visualisation key and at least one activity must be specified")
+	}
+	ids, err := parseActivityIDs(c.Args().Tail())
+	if err != nil {
+		return err
+	}
+	client, err := doaramacli.NewAuthenticatedDoaramaClient(c)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	ac, err := doaramacli.NewActivityCreator(c, client)
+	if err != nil {
+		return err
+	}
+	defer ac.Close()
+	v := client.Visualisation(c.Args().First())
+	as := make([]*doarama.Activity, len(ids))
+	for i, id := range ids {
+		as[i] = client.Activity(id)
+	}
+	if err := f(doaramacli.VisualisationManager(ac, client), ctx, v, as); err != nil {
+		return out.Fail(err)
+	}
+	return out.Write(&doaramacli.Record{
+		Type: "visualisation",
+		Fields: []doaramacli.Field{
+			{Name: "VisualisationKey", Value: v.Key},
+			{Name: "ActivityIds", Value: ids},
+		},
+	})
+}
+
+func visualisationDelete(c *cli.Context) error {
+	ctx := context.Background()
+	out, err := doaramacli.NewOutput(c)
+	if err != nil {
+		return err
+	}
+	client, err := doaramacli.NewAuthenticatedDoaramaClient(c)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	ac, err := doaramacli.NewActivityCreator(c, client)
+	if err != nil {
+		return err
+	}
+	defer ac.Close()
+	vm := doaramacli.VisualisationManager(ac, client)
+	for _, key := range c.Args() {
+		r := &doaramacli.Record{
+			Type:   "visualisation",
+			Fields: []doaramacli.Field{{Name: "VisualisationKey", Value: key}},
+			Err:    vm.DeleteVisualisation(ctx, client.Visualisation(key)),
+		}
+		if r.Err == nil {
+			r.Fields = append(r.Fields, doaramacli.Field{Name: "Deleted", Value: true})
+		}
+		if err := out.Write(r); err != nil {
+			return err
+		}
+	}
+	return out.Err()
 }
 
 func visualisationURL(c *cli.Context) error {
+	out, err := doaramacli.NewOutput(c)
+	if err != nil {
+		return err
+	}
 	client := doaramacli.NewDoaramaClient(c)
 	vuo := doaramacli.NewVisualisationURLOptions(c)
 	for _, arg := range c.Args() {
-		v := client.Visualisation(arg)
-		fmt.Printf("VisualisationURL: %s\n", v.URL(vuo))
+		r := visualisationRecord(client.Visualisation(arg), vuo)
+		r.Text = fmt.Sprintf("VisualisationURL: %s", r.Fields[1].Value)
+		if err := out.Write(r); err != nil {
+			return err
+		}
 	}
 	return nil
 }
@@ -180,6 +1145,8 @@ func main() {
 	app.Name = "doarama"
 	app.Usage = "A command line interface to doarama.com"
 	app.Flags = doaramacli.Flags
+	app.Before = doaramacli.LoadProfile
+	app.ExitErrHandler = doaramacli.HandleExitErr
 	app.Commands = []cli.Command{
 		{
 			Name:    "activity",
@@ -191,7 +1158,7 @@ func main() {
 					Aliases: []string{"c"},
 					Usage:   "Creates an activity from one or more tracklogs",
 					Action:  activityCreate,
-					Flags:   []cli.Flag{doaramacli.ActivityTypeFlag},
+					Flags:   []cli.Flag{doaramacli.ActivityTypeFlag, doaramacli.JobsFlag, doaramacli.TimeOffsetFlag, doaramacli.FilterFlag},
 				},
 				{
 					Name:    "delete",
@@ -201,12 +1168,124 @@ func main() {
 				},
 			},
 		},
+		{
+			Name:  "cache",
+			Usage: "Manages the activity cache",
+			Subcommands: []cli.Command{
+				{
+					Name:    "delete",
+					Aliases: []string{"d"},
+					Usage:   "Removes one or more activities from the cache by id",
+					Action:  cacheDelete,
+				},
+				{
+					Name:   "export",
+					Usage:  "Exports the cache as JSON to a file or the standard output",
+					Action: cacheExport,
+				},
+				{
+					Name:   "import",
+					Usage:  "Imports one or more JSON files into the cache",
+					Action: cacheImport,
+				},
+				{
+					Name:    "list",
+					Aliases: []string{"l"},
+					Usage:   "Lists cached activities",
+					Action:  cacheList,
+				},
+				{
+					Name:   "prune",
+					Usage:  "Removes cached activities that have expired or no longer exist on the server",
+					Action: cachePrune,
+					Flags: []cli.Flag{
+						cli.DurationFlag{
+							Name:  "older-than",
+							Usage: "also remove cached activities older than this",
+						},
+					},
+				},
+				{
+					Name:    "show",
+					Aliases: []string{"s"},
+					Usage:   "Shows one or more cached activities by id",
+					Action:  cacheShow,
+				},
+			},
+		},
 		{
 			Name:    "create",
 			Aliases: []string{"c"},
 			Usage:   "Creates a visualisation URL from one or more tracklogs",
 			Action:  create,
-			Flags:   append([]cli.Flag{doaramacli.ActivityTypeFlag}, doaramacli.VisualisationFlags...),
+			Flags: append([]cli.Flag{
+				doaramacli.ActivityTypeFlag,
+				doaramacli.JobsFlag,
+				doaramacli.TimeOffsetFlag,
+				doaramacli.FilterFlag,
+				cli.StringFlag{
+					Name:  "group-by",
+					Value: "none",
+					Usage: "how to group tracklogs into visualisations: none or overlap",
+				},
+			}, doaramacli.VisualisationFlags...),
+		},
+		{
+			Name:  "config",
+			Usage: "Manages configuration profiles",
+			Subcommands: []cli.Command{
+				{
+					Name:   "get",
+					Usage:  "Prints the value of a key in the current profile",
+					Action: configGet,
+				},
+				{
+					Name:   "list",
+					Usage:  "Lists the keys and values in the current profile",
+					Action: configList,
+				},
+				{
+					Name:   "set",
+					Usage:  "Sets the value of a key in the current profile, or removes it if the value is empty",
+					Action: configSet,
+				},
+			},
+		},
+		{
+			Name:   "convert",
+			Usage:  "Converts a tracklog between GPX and IGC formats",
+			Action: convert,
+			Flags:  []cli.Flag{doaramacli.TimeOffsetFlag, doaramacli.FilterFlag},
+		},
+		{
+			Name:    "merge",
+			Aliases: []string{"m"},
+			Usage:   "Merges tracklogs of the same activity and creates an activity",
+			Action:  merge,
+			Flags: []cli.Flag{
+				doaramacli.ActivityTypeFlag,
+				doaramacli.TimeOffsetFlag,
+				doaramacli.FilterFlag,
+				cli.StringFlag{
+					Name:  "write, w",
+					Usage: "write the merged tracklog to a file instead of creating an activity",
+				},
+				cli.DurationFlag{
+					Name:  "tolerance",
+					Value: doarama.DefaultMergeTolerance,
+					Usage: "maximum time difference between duplicate samples",
+				},
+				cli.DurationFlag{
+					Name:  "maxgap",
+					Value: doarama.DefaultMergeMaxGap,
+					Usage: "longest gap that is not filled from secondary tracklogs",
+				},
+				cli.IntFlag{
+					Name:  "altitudesource",
+					Value: -1,
+					Usage: "index of the tracklog to take altitudes from, or -1 to choose automatically",
+				},
+			},
 		},
 		{
 			Name:    "query-activity-types",
@@ -225,6 +1304,24 @@ func main() {
 					Usage:   "Creates a visualisation from a list of activities",
 					Action:  visualisationCreate,
 				},
+				{
+					Name:    "add",
+					Aliases: []string{"a"},
+					Usage:   "Adds activities to a visualisation",
+					Action:  visualisationAdd,
+				},
+				{
+					Name:    "remove",
+					Aliases: []string{"r"},
+					Usage:   "Removes activities from a visualisation",
+					Action:  visualisationRemove,
+				},
+				{
+					Name:    "delete",
+					Aliases: []string{"d"},
+					Usage:   "Deletes visualisations",
+					Action:  visualisationDelete,
+				},
 				{
 					Name:    "url",
 					Aliases: []string{"u"},
@@ -234,6 +1331,34 @@ func main() {
 				},
 			},
 		},
+		{
+			Name:    "watch",
+			Aliases: []string{"w"},
+			Usage:   "Watches a directory and uploads new or changed tracklogs",
+			Action:  watch,
+			Flags: append([]cli.Flag{
+				doaramacli.ActivityTypeFlag,
+				doaramacli.TimeOffsetFlag,
+				doaramacli.FilterFlag,
+				cli.BoolFlag{
+					Name:  "existing",
+					Usage: "also upload tracklogs already in the directory",
+				},
+				cli.BoolFlag{
+					Name:  "group-by-date",
+					Usage: "create one visualisation per day instead of one per tracklog",
+				},
+				cli.StringFlag{
+					Name:  "output-file",
+					Usage: "append visualisation URLs to this file instead of printing them",
+				},
+				cli.DurationFlag{
+					Name:  "settle",
+					Value: 5 * time.Second,
+					Usage: "time to wait after the last write before uploading a tracklog",
+				},
+			}, doaramacli.VisualisationFlags...),
+		},
 	}
 	if err := app.Run(os.Args); err != nil {
 		log.Fatal(err)
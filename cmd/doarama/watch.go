@@ -0,0 +1,334 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/twpayne/go-doarama"
+	"github.com/twpayne/go-doarama/doaramacache"
+	"github.com/twpayne/go-doarama/doaramacli"
+	"github.com/urfave/cli"
+)
+
+// A watchGroup is a visualisation of the tracklogs with the same label.
+type watchGroup struct {
+	visualisation *doarama.Visualisation
+	activities    map[string]*doarama.Activity
+}
+
+// A watcher uploads tracklogs as they appear in a directory.
+type watcher struct {
+	ac           doaramacache.ActivityCreator
+	vc           doaramacache.VisualisationCreator
+	vm           doaramacache.VisualisationManager
+	activityInfo *doarama.ActivityInfo
+	transform    transformFunc
+	vuo          *doarama.VisualisationURLOptions
+	groupByDate  bool
+	out          *doaramacli.Output
+	output       io.Writer
+	groups       map[string]*watchGroup
+	labels       map[string]string
+}
+
+// A pendingUpload is a tracklog waiting to settle before it is uploaded.
+type pendingUpload struct {
+	filename string
+	timer    *time.Timer
+}
+
+// isTracklog returns whether filename has the extension of a supported
+// tracklog format.
+func isTracklog(filename string) bool {
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".gpx", ".igc":
+		return true
+	default:
+		return false
+	}
+}
+
+// date returns the UTC date of the first sample in filename.
+func (w *watcher) date(filename string) (string, error) {
+	samples, err := readSamples(filename)
+	if err != nil {
+		return "", err
+	}
+	if w.transform != nil {
+		samples = w.transform(samples)
+	}
+	if len(samples) == 0 {
+		return "", fmt.Errorf("%s: no samples", filename)
+	}
+	return samples[0].Time.Time().UTC().Format("2006-01-02"), nil
+}
+
+// upload uploads filename and creates or updates its visualisation.
+func (w *watcher) upload(ctx context.Context, filename string) error {
+	upload := newUpload(filename, w.activityInfo, w.transform)
+	r, err := upload.Open()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	a, err := w.ac.CreateActivityWithInfo(ctx, upload.Filename, r, upload.ActivityInfo)
+	if err != nil {
+		return err
+	}
+	// In text format, only the visualisation URLs are printed.
+	ar := activityRecord(filename, a, nil)
+	ar.Text = ""
+	if err := w.out.Write(ar); err != nil {
+		return err
+	}
+	label := filepath.Base(filename)
+	if w.groupByDate {
+		if label, err = w.date(filename); err != nil {
+			return err
+		}
+	}
+	v, err := w.add(ctx, label, filename, a)
+	if err != nil {
+		return err
+	}
+	u := v.URL(w.vuo).String()
+	if w.output != nil {
+		_, err = fmt.Fprintf(w.output, "%s\t%s\n", label, u)
+		return err
+	}
+	return w.out.Write(&doaramacli.Record{
+		Type: "visualisation",
+		File: filename,
+		Fields: []doaramacli.Field{
+			{Name: "Label", Value: label},
+			{Name: "VisualisationKey", Value: v.Key},
+			{Name: "VisualisationURL", Value: u},
+		},
+		Text: label + "\t" + u,
+	})
+}
+
+// add adds the activity a uploaded from filename to the visualisation of
+// label, creating the visualisation if needed. If filename was uploaded
+// before as a different activity then the old activity is removed from its
+// visualisation and deleted, so a visualisation keeps its URL as its
+// tracklogs change.
+func (w *watcher) add(ctx context.Context, label, filename string, a *doarama.Activity) (*doarama.Visualisation, error) {
+	oldLabel, uploaded := w.labels[filename]
+	var old *doarama.Activity
+	if uploaded {
+		old = w.groups[oldLabel].activities[filename]
+		if oldLabel == label && old.ID == a.ID {
+			return w.groups[label].visualisation, nil
+		}
+	}
+	g, ok := w.groups[label]
+	switch {
+	case !ok:
+		v, err := w.vc.CreateVisualisation(ctx, []*doarama.Activity{a})
+		if err != nil {
+			return nil, err
+		}
+		g = &watchGroup{
+			visualisation: v,
+			activities:    make(map[string]*doarama.Activity),
+		}
+		w.groups[label] = g
+	case !g.contains(a):
+		if err := w.vm.AddActivities(ctx, g.visualisation, []*doarama.Activity{a}); err != nil {
+			return nil, err
+		}
+	}
+	g.activities[filename] = a
+	w.labels[filename] = label
+	if !uploaded {
+		return g.visualisation, nil
+	}
+	oldGroup := w.groups[oldLabel]
+	if oldGroup != g {
+		delete(oldGroup.activities, filename)
+	}
+	switch {
+	case oldGroup.contains(old):
+	case len(oldGroup.activities) == 0:
+		delete(w.groups, oldLabel)
+		if err := w.vm.DeleteVisualisation(ctx, oldGroup.visualisation); err != nil {
+			return nil, err
+		}
+	default:
+		if err := w.vm.RemoveActivities(ctx, oldGroup.visualisation, []*doarama.Activity{old}); err != nil {
+			return nil, err
+		}
+	}
+	if old.ID != a.ID && !w.uses(old) {
+		if err := w.ac.DeleteActivity(ctx, old); err != nil {
+			return nil, err
+		}
+	}
+	return g.visualisation, nil
+}
+
+// contains returns whether g's visualisation contains a.
+func (g *watchGroup) contains(a *doarama.Activity) bool {
+	for _, ga := range g.activities {
+		if ga.ID == a.ID {
+			return true
+		}
+	}
+	return false
+}
+
+// uses returns whether any tracklog was uploaded as a.
+func (w *watcher) uses(a *doarama.Activity) bool {
+	for _, g := range w.groups {
+		if g.contains(a) {
+			return true
+		}
+	}
+	return false
+}
+
+// watch uploads the tracklogs in dir that are created or changed until ctx is
+// done. A tracklog is uploaded once it has not been written to for settle.
+// If existing is true then tracklogs already in dir are uploaded too.
+func (w *watcher) watch(ctx context.Context, dir string, settle time.Duration, existing bool) error {
+	fsw, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer fsw.Close()
+	if err := fsw.Add(dir); err != nil {
+		return err
+	}
+	pending := make(map[string]*pendingUpload)
+	settled := make(chan *pendingUpload)
+	schedule := func(filename string) {
+		// If the timer has already fired then its upload is discarded when
+		// it is received, as it is no longer pending.
+		if p, ok := pending[filename]; ok && p.timer.Stop() {
+			p.timer.Reset(settle)
+			return
+		}
+		p := &pendingUpload{filename: filename}
+		p.timer = time.AfterFunc(settle, func() {
+			select {
+			case settled <- p:
+			case <-ctx.Done():
+			}
+		})
+		pending[filename] = p
+	}
+	if existing {
+		fis, err := ioutil.ReadDir(dir)
+		if err != nil {
+			return err
+		}
+		for _, fi := range fis {
+			if fi.Mode().IsRegular() && isTracklog(fi.Name()) {
+				schedule(filepath.Join(dir, fi.Name()))
+			}
+		}
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			for _, p := range pending {
+				p.timer.Stop()
+			}
+			return nil
+		case event, ok := <-fsw.Events:
+			if !ok {
+				return nil
+			}
+			if event.Op&(fsnotify.Create|fsnotify.Write) != 0 && isTracklog(event.Name) {
+				schedule(event.Name)
+			}
+		case err, ok := <-fsw.Errors:
+			if !ok {
+				return nil
+			}
+			if err := w.out.Write(&doaramacli.Record{Type: "error", Err: err}); err != nil {
+				return err
+			}
+		case p := <-settled:
+			if pending[p.filename] != p {
+				continue
+			}
+			delete(pending, p.filename)
+			filename := p.filename
+			if fi, err := os.Stat(filename); err != nil || !fi.Mode().IsRegular() {
+				continue
+			}
+			if err := w.upload(ctx, filename); err != nil {
+				if err := w.out.Write(&doaramacli.Record{
+					Type: "error",
+					File: filename,
+					Err:  fmt.Errorf("%s: %v", filename, err),
+				}); err != nil {
+					return err
+				}
+			}
+		}
+	}
+}
+
+func watch(c *cli.Context) error {
+	if len(c.Args()) != 1 {
+		return errors.New("exactly one directory must be specified")
+	}
+	ctx, cancel := interruptContext()
+	defer cancel()
+	out, err := doaramacli.NewOutput(c)
+	if err != nil {
+		return err
+	}
+	client, err := doaramacli.NewAuthenticatedDoaramaClient(c)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	activityType, err := doarama.DefaultActivityTypes.Find(doaramacli.ActivityType(c))
+	if err != nil {
+		return err
+	}
+	transform, err := newTransform(c)
+	if err != nil {
+		return err
+	}
+	ac, err := doaramacli.NewActivityCreator(c, client)
+	if err != nil {
+		return err
+	}
+	defer ac.Close()
+	w := &watcher{
+		ac: ac,
+		vc: doaramacli.VisualisationCreator(ac, client),
+		vm: doaramacli.VisualisationManager(ac, client),
+		activityInfo: &doarama.ActivityInfo{
+			TypeID: activityType.ID,
+		},
+		transform:   transform,
+		vuo:         doaramacli.NewVisualisationURLOptions(c),
+		groupByDate: c.Bool("group-by-date"),
+		out:         out,
+		groups:      make(map[string]*watchGroup),
+		labels:      make(map[string]string),
+	}
+	if output := c.String("output-file"); output != "" {
+		f, err := os.OpenFile(output, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0666)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w.output = f
+	}
+	return w.watch(ctx, c.Args().First(), c.Duration("settle"), c.Bool("existing"))
+}
@@ -5,11 +5,12 @@ package doarama
 import (
 	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
-	"mime/multipart"
 	"net/http"
 	"net/url"
 	"runtime"
@@ -36,6 +37,13 @@ func (e Error) Error() string {
 	return fmt.Sprintf("doarama: %d %s: %s: %s", e.HTTPStatusCode, e.HTTPStatus, e.Status, e.Message)
 }
 
+// IsNotFound returns true if err is a Doarama server error indicating that
+// the requested resource does not exist.
+func IsNotFound(err error) bool {
+	e, ok := err.(Error)
+	return ok && e.HTTPStatusCode == http.StatusNotFound
+}
+
 // An ErrAmbiguousActivityType is returned when an activity type is ambiguous.
 type ErrAmbiguousActivityType struct {
 	S       string
@@ -60,15 +68,47 @@ func (e *ErrUnknownActivityType) Error() string {
 	return fmt.Sprintf("unknown activity type %q", e.S)
 }
 
+// An AltitudeReference is the reference surface that recorded altitudes are
+// measured from.
+type AltitudeReference string
+
+// AltitudeReferenceWGS84 is height above the WGS84 ellipsoid, as reported by
+// most GPS receivers. It is the only altitude reference that Record accepts.
+const AltitudeReferenceWGS84 AltitudeReference = "WGS84"
+
+// An ErrUnknownAltitudeReference is returned when an altitude reference is
+// unknown.
+type ErrUnknownAltitudeReference struct {
+	S string
+}
+
+func (e *ErrUnknownAltitudeReference) Error() string {
+	return fmt.Sprintf("unknown altitude reference %q", e.S)
+}
+
+// Validate returns an error if r is not a known altitude reference.
+func (r AltitudeReference) Validate() error {
+	switch r {
+	case AltitudeReferenceWGS84:
+		return nil
+	default:
+		return &ErrUnknownAltitudeReference{S: string(r)}
+	}
+}
+
 // A Client is an opaque type for a Doarama client.
 type Client struct {
-	apiName    string
-	apiKey     string
-	apiURL     string
-	httpClient *http.Client
-	userAgent  string
-	userHeader string
-	user       string
+	apiName       string
+	apiKey        string
+	apiURL        string
+	httpClient    *http.Client
+	userAgent     string
+	userHeader    string
+	user          string
+	privacyFilter *PrivacyFilter
+	progress      ProgressFunc
+	maxRetries    int
+	retryDelay    time.Duration
 }
 
 // An ActivityInfo represents the info associated with an activity.
@@ -186,6 +226,7 @@ func NewClient(options ...ClientOption) *Client {
 		apiURL:     DefaultAPIURL,
 		httpClient: &http.Client{},
 		userAgent:  defaultUserAgent(),
+		retryDelay: time.Second,
 	}
 	for _, option := range options {
 		option(c)
@@ -246,9 +287,8 @@ func (c *Client) doRequest(ctx context.Context, req *http.Request, v interface{}
 			Status  string `json:"status"`
 			Message string `json:"message"`
 		}
-		if err := json.Unmarshal(body, &r); err != nil {
-			return err
-		}
+		// The body is not always JSON, for example for 404 Not Found errors.
+		_ = json.Unmarshal(body, &r)
 		return Error{
 			HTTPStatusCode: resp.StatusCode,
 			HTTPStatus:     resp.Status,
@@ -285,40 +325,42 @@ func (c *Client) Activity(id int) *Activity {
 	}
 }
 
+// APIName returns the API name.
+func (c *Client) APIName() string {
+	return c.apiName
+}
+
+// APIURL returns the API URL.
+func (c *Client) APIURL() string {
+	return c.apiURL
+}
+
 // Close releases any associated resources.
 func (c *Client) Close() error {
 	return nil
 }
 
-// CreateActivity creates a new activity.
+// CreateActivity creates a new activity. If the client has a privacy filter
+// then it is applied to gpsTrack, whose format is determined from filename.
+// Only the base of filename is sent to the server.
+// gpsTrack is streamed to the server rather than buffered in memory. If
+// gpsTrack implements io.Seeker then failed uploads are retried as set by
+// MaxRetries.
 func (c *Client) CreateActivity(ctx context.Context, filename string, gpsTrack io.Reader) (*Activity, error) {
-	var b bytes.Buffer
-	w := multipart.NewWriter(&b)
-	fw, err := w.CreateFormFile("gps_track", filename)
-	if err != nil {
-		return nil, err
+	s, ok := gpsTrack.(io.ReadSeeker)
+	if !ok {
+		return c.createActivityOnce(ctx, filename, gpsTrack)
 	}
-	if _, err = io.Copy(fw, gpsTrack); err != nil {
-		return nil, err
-	}
-	if err := w.Close(); err != nil {
-		return nil, err
-	}
-	req, err := c.newRequest("POST", c.apiURL+"/activity", &b)
+	start, err := s.Seek(0, io.SeekCurrent)
 	if err != nil {
-		return nil, err
+		return c.createActivityOnce(ctx, filename, gpsTrack)
 	}
-	req.Header.Set("Content-Type", w.FormDataContentType())
-	data := struct {
-		ID int `json:"id"`
-	}{}
-	if err := c.doRequest(ctx, req, &data); err != nil {
-		return nil, err
-	}
-	return &Activity{
-		Client: c,
-		ID:     data.ID,
-	}, nil
+	return c.CreateActivityFunc(ctx, filename, func() (io.ReadCloser, error) {
+		if _, err := s.Seek(start, io.SeekStart); err != nil {
+			return nil, err
+		}
+		return nopSeekCloser{s}, nil
+	})
 }
 
 // CreateActivityWithInfo creates a new doarama.Activity with the specified
@@ -377,6 +419,47 @@ func (c *Client) CreateVisualisation(ctx context.Context, activities []*Activity
 	return v, nil
 }
 
+// AddActivities adds activities to v.
+func (c *Client) AddActivities(ctx context.Context, v *Visualisation, activities []*Activity) error {
+	return v.AddActivities(ctx, activities)
+}
+
+// DeleteActivity deletes activity.
+func (c *Client) DeleteActivity(ctx context.Context, activity *Activity) error {
+	return activity.Delete(ctx)
+}
+
+// DeleteVisualisation deletes v.
+func (c *Client) DeleteVisualisation(ctx context.Context, v *Visualisation) error {
+	return v.Delete(ctx)
+}
+
+// Identity returns a string identifying the user that the client is
+// authenticated as, or the empty string if the client is not authenticated.
+// Delegate user keys are hashed so that the identity can be stored safely.
+func (c *Client) Identity() string {
+	switch {
+	case c.user == "":
+		return ""
+	case c.userHeader == "user-key":
+		h := sha256.Sum256([]byte(c.user))
+		return "user-key-sha256:" + hex.EncodeToString(h[:])
+	default:
+		return c.userHeader + ":" + c.user
+	}
+}
+
+// PrivacyFilter returns the privacy filter applied to uploaded GPS tracks, or
+// nil.
+func (c *Client) PrivacyFilter() *PrivacyFilter {
+	return c.privacyFilter
+}
+
+// RemoveActivities removes activities from v.
+func (c *Client) RemoveActivities(ctx context.Context, v *Visualisation, activities []*Activity) error {
+	return v.RemoveActivities(ctx, activities)
+}
+
 // Visualisation returns the visualisation with the specified key.
 func (c *Client) Visualisation(key string) *Visualisation {
 	return &Visualisation{
@@ -429,6 +512,30 @@ func Delegate(userKey string) ClientOption {
 	}
 }
 
+// MaxRetries sets the maximum number of times that an upload is retried after
+// a network error or a 429 or 5xx response. Retries wait for an exponentially
+// increasing delay. The default is not to retry.
+func MaxRetries(maxRetries int) ClientOption {
+	return func(c *Client) {
+		c.maxRetries = maxRetries
+	}
+}
+
+// Privacy sets a privacy filter that is applied to all tracks and samples
+// uploaded.
+func Privacy(privacyFilter *PrivacyFilter) ClientOption {
+	return func(c *Client) {
+		c.privacyFilter = privacyFilter
+	}
+}
+
+// Progress sets a function that is called to report the progress of uploads.
+func Progress(progress ProgressFunc) ClientOption {
+	return func(c *Client) {
+		c.progress = progress
+	}
+}
+
 // UserAgent sets the user agent.
 func UserAgent(userAgent string) ClientOption {
 	return func(c *Client) {
@@ -448,13 +555,35 @@ func (a *Activity) Delete(ctx context.Context) error {
 	return nil
 }
 
-// Record records zero or more samples. altitudeReference should normally be
-// "WGS84".
-func (a *Activity) Record(ctx context.Context, samples []*Sample, altitudeReference string) error {
+// Info returns the activity's info. It returns an error for which IsNotFound
+// returns true if the activity does not exist.
+func (a *Activity) Info(ctx context.Context) (*ActivityInfo, error) {
+	req, err := a.Client.newRequest("GET", a.URL(), nil)
+	if err != nil {
+		return nil, err
+	}
+	activityInfo := &ActivityInfo{}
+	if err := a.Client.doRequest(ctx, req, activityInfo); err != nil {
+		return nil, err
+	}
+	return activityInfo, nil
+}
+
+// Record records zero or more samples. altitudeReference must be
+// AltitudeReferenceWGS84. Altitudes above mean sea level must be converted to
+// heights above the WGS84 ellipsoid by the caller. If the client has a privacy
+// filter then it is applied to samples.
+func (a *Activity) Record(ctx context.Context, samples []*Sample, altitudeReference AltitudeReference) error {
+	if err := altitudeReference.Validate(); err != nil {
+		return err
+	}
+	if a.Client.privacyFilter.active() {
+		samples = a.Client.privacyFilter.applyPtrs(samples)
+	}
 	data := struct {
-		Samples           []*Sample `json:"samples"`
-		ActivityID        int       `json:"activityId"`
-		AltitudeReference string    `json:"altitudeReference"`
+		Samples           []*Sample         `json:"samples"`
+		ActivityID        int               `json:"activityId"`
+		AltitudeReference AltitudeReference `json:"altitudeReference"`
 	}{
 		Samples:           samples,
 		ActivityID:        a.ID,
@@ -489,6 +618,30 @@ func (a *Activity) URL() string {
 
 // AddActivities adds the activities to the visualisation.
 func (v *Visualisation) AddActivities(ctx context.Context, activities []*Activity) error {
+	return v.postActivities(ctx, "/visualisation/addActivities", activities)
+}
+
+// Delete deletes the visualisation. It returns an error for which IsNotFound
+// returns true if the visualisation does not exist.
+func (v *Visualisation) Delete(ctx context.Context) error {
+	req, err := v.Client.newRequest("DELETE", v.Client.apiURL+"/visualisation/"+url.PathEscape(v.Key), nil)
+	if err != nil {
+		return err
+	}
+	if err := v.Client.doRequest(ctx, req, nil); err != nil {
+		return err
+	}
+	return nil
+}
+
+// RemoveActivities removes the activities from the visualisation. The
+// activities themselves are not deleted.
+func (v *Visualisation) RemoveActivities(ctx context.Context, activities []*Activity) error {
+	return v.postActivities(ctx, "/visualisation/removeActivities", activities)
+}
+
+// postActivities posts the IDs of activities in the visualisation to path.
+func (v *Visualisation) postActivities(ctx context.Context, path string, activities []*Activity) error {
 	data := struct {
 		VisualisationKey string `json:"visualisationKey"`
 		ActivityIds      []int  `json:"activityIds"`
@@ -499,7 +652,7 @@ func (v *Visualisation) AddActivities(ctx context.Context, activities []*Activit
 	for i, activity := range activities {
 		data.ActivityIds[i] = activity.ID
 	}
-	req, err := v.Client.newRequestJSON("POST", v.Client.apiURL+"/visualisation/addActivities", &data)
+	req, err := v.Client.newRequestJSON("POST", v.Client.apiURL+path, &data)
 	if err != nil {
 		return err
 	}
@@ -1,7 +1,20 @@
 package doarama
 
 import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
 	"testing"
+	"testing/iotest"
 	"time"
 )
 
@@ -31,3 +44,647 @@ func TestTime(t *testing.T) {
 		}
 	}
 }
+
+func TestActivityInfo(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/activity/1":
+			w.Write([]byte(`{"id": 1, "activityTypeId": 29, "userName": "Tom Payne"}`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer ts.Close()
+	ctx := context.Background()
+	client := NewClient(APIURL(ts.URL))
+	want := &ActivityInfo{TypeID: 29, UserName: "Tom Payne"}
+	if got, err := client.Activity(1).Info(ctx); err != nil || !reflect.DeepEqual(got, want) {
+		t.Errorf("client.Activity(1).Info(ctx) == %#v, %v, want %#v, nil", got, err, want)
+	}
+	if _, err := client.Activity(2).Info(ctx); !IsNotFound(err) {
+		t.Errorf("client.Activity(2).Info(ctx) == ..., %v, want ..., not found", err)
+	}
+}
+
+func TestVisualisationManagement(t *testing.T) {
+	var got []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if r.URL.Path == "/visualisation/missing" {
+			http.NotFound(w, r)
+			return
+		}
+		got = append(got, strings.TrimSpace(r.Method+" "+r.URL.Path+" "+string(body)))
+		w.Write([]byte(`{}`))
+	}))
+	defer ts.Close()
+	ctx := context.Background()
+	client := NewClient(APIURL(ts.URL))
+	v := client.Visualisation("abc")
+	activities := []*Activity{client.Activity(1), client.Activity(2)}
+	for _, tc := range []struct {
+		name string
+		f    func() error
+		want string
+	}{
+		{
+			name: "AddActivities",
+			f:    func() error { return client.AddActivities(ctx, v, activities) },
+			want: `POST /visualisation/addActivities {"visualisationKey":"abc","activityIds":[1,2]}`,
+		},
+		{
+			name: "RemoveActivities",
+			f:    func() error { return client.RemoveActivities(ctx, v, activities[1:]) },
+			want: `POST /visualisation/removeActivities {"visualisationKey":"abc","activityIds":[2]}`,
+		},
+		{
+			name: "DeleteVisualisation",
+			f:    func() error { return client.DeleteVisualisation(ctx, v) },
+			want: `DELETE /visualisation/abc`,
+		},
+	} {
+		got = nil
+		if err := tc.f(); err != nil || len(got) != 1 || got[0] != tc.want {
+			t.Errorf("client.%s(...) == %v with requests %q, want nil with requests [%q]", tc.name, err, got, tc.want)
+		}
+	}
+	if err := client.Visualisation("missing").Delete(ctx); !IsNotFound(err) {
+		t.Errorf("client.Visualisation(\"missing\").Delete(ctx) == %v, want not found", err)
+	}
+}
+
+func TestCreateActivity(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		f, fh, err := r.FormFile("gps_track")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		defer f.Close()
+		content, err := ioutil.ReadAll(f)
+		if err != nil || fh.Filename != "track.igc" || string(content) != "track" {
+			http.Error(w, "unexpected gps_track", http.StatusBadRequest)
+			return
+		}
+		w.Write([]byte(`{"id": 1}`))
+	}))
+	defer ts.Close()
+	ctx := context.Background()
+	client := NewClient(APIURL(ts.URL))
+	if a, err := client.CreateActivity(ctx, "track.igc", strings.NewReader("track")); err != nil || a.ID != 1 {
+		t.Errorf("client.CreateActivity(...) == %v, %v, want activity 1, nil", a, err)
+	}
+	if _, err := client.CreateActivity(ctx, "track.igc", iotest.TimeoutReader(strings.NewReader("track"))); err == nil {
+		t.Errorf("client.CreateActivity(...) with failing reader == ..., nil, want ..., non-nil")
+	}
+}
+
+func TestCreateActivityRetries(t *testing.T) {
+	var requests int
+	var contentLengths []int64
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		contentLengths = append(contentLengths, r.ContentLength)
+		f, _, err := r.FormFile("gps_track")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		defer f.Close()
+		if content, err := ioutil.ReadAll(f); err != nil || string(content) != "track" {
+			http.Error(w, "unexpected gps_track", http.StatusBadRequest)
+			return
+		}
+		if requests%3 != 0 {
+			http.Error(w, "try again", http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte(`{"id": 1}`))
+	}))
+	defer ts.Close()
+	ctx := context.Background()
+	var sent, total int64
+	client := NewClient(
+		APIURL(ts.URL),
+		MaxRetries(2),
+		Progress(func(filename string, s, t int64) {
+			sent, total = s, t
+		}),
+	)
+	client.retryDelay = time.Millisecond
+
+	if a, err := client.CreateActivity(ctx, "track.igc", strings.NewReader("track")); err != nil || a.ID != 1 || requests != 3 {
+		t.Errorf("client.CreateActivity(...) == %v, %v after %d requests, want activity 1, nil after 3 requests", a, err, requests)
+	}
+	if contentLengths[0] <= int64(len("track")) || !reflect.DeepEqual(contentLengths, []int64{contentLengths[0], contentLengths[0], contentLengths[0]}) {
+		t.Errorf("got content lengths %v, want three equal known lengths", contentLengths)
+	}
+	if sent != total || total != contentLengths[0] {
+		t.Errorf("got progress %d/%d, want %d/%d", sent, total, contentLengths[0], contentLengths[0])
+	}
+
+	requests, contentLengths = 0, nil
+	if _, err := client.CreateActivity(ctx, "track.igc", iotest.OneByteReader(strings.NewReader("track"))); err == nil || requests != 1 {
+		t.Errorf("client.CreateActivity(...) with unseekable reader == ..., %v after %d requests, want ..., non-nil after 1 request", err, requests)
+	}
+	if !reflect.DeepEqual(contentLengths, []int64{-1}) || total != -1 {
+		t.Errorf("got content lengths %v and total %d, want [-1] and -1", contentLengths, total)
+	}
+
+	requests, contentLengths = 0, nil
+	opens := 0
+	open := func() (io.ReadCloser, error) {
+		opens++
+		return ioutil.NopCloser(iotest.OneByteReader(strings.NewReader("track"))), nil
+	}
+	if a, err := client.CreateActivityFunc(ctx, "track.igc", open); err != nil || a.ID != 1 || opens != 3 {
+		t.Errorf("client.CreateActivityFunc(...) == %v, %v after %d opens, want activity 1, nil after 3 opens", a, err, opens)
+	}
+
+	opens = 0
+	open = func() (io.ReadCloser, error) {
+		opens++
+		return ioutil.NopCloser(iotest.TimeoutReader(iotest.OneByteReader(strings.NewReader("track")))), nil
+	}
+	if _, err := client.CreateActivityFunc(ctx, "track.igc", open); err != iotest.ErrTimeout || opens != 1 {
+		t.Errorf("client.CreateActivityFunc(...) with failing reader == ..., %v after %d opens, want ..., %v after 1 open", err, opens, iotest.ErrTimeout)
+	}
+
+	opens = 0
+	open = func() (io.ReadCloser, error) {
+		opens++
+		return ioutil.NopCloser(strings.NewReader("not gpx")), nil
+	}
+	client.privacyFilter = &PrivacyFilter{Zones: []PrivacyZone{{Latitude: 47, Longitude: 13, Radius: 1000}}}
+	if _, err := client.CreateActivityFunc(ctx, "track.gpx", open); err == nil || opens != 1 {
+		t.Errorf("client.CreateActivityFunc(...) with invalid GPX == ..., %v after %d opens, want ..., non-nil after 1 open", err, opens)
+	}
+}
+
+func TestCreateActivityRetriesNetworkErrors(t *testing.T) {
+	var requests int
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if requests == 1 {
+			conn, _, err := w.(http.Hijacker).Hijack()
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			conn.Close()
+			return
+		}
+		ioutil.ReadAll(r.Body)
+		w.Write([]byte(`{"id": 1}`))
+	}))
+	defer ts.Close()
+	client := NewClient(APIURL(ts.URL), MaxRetries(2))
+	client.retryDelay = time.Millisecond
+	if a, err := client.CreateActivity(context.Background(), "track.igc", strings.NewReader("track")); err != nil || a.ID != 1 || requests != 2 {
+		t.Errorf("client.CreateActivity(...) == %v, %v after %d requests, want activity 1, nil after 2 requests", a, err, requests)
+	}
+}
+
+func TestRecord(t *testing.T) {
+	var requests int
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Write([]byte(`{}`))
+	}))
+	defer ts.Close()
+	ctx := context.Background()
+	a := NewClient(APIURL(ts.URL)).Activity(1)
+	for _, tc := range []struct {
+		altitudeReference AltitudeReference
+		wantErr           error
+		wantRequests      int
+	}{
+		{altitudeReference: AltitudeReferenceWGS84, wantRequests: 1},
+		{altitudeReference: "EGM96", wantErr: &ErrUnknownAltitudeReference{}},
+		{altitudeReference: "", wantErr: &ErrUnknownAltitudeReference{}},
+	} {
+		requests = 0
+		err := a.Record(ctx, nil, tc.altitudeReference)
+		if reflect.TypeOf(err) != reflect.TypeOf(tc.wantErr) || requests != tc.wantRequests {
+			t.Errorf("a.Record(ctx, nil, %q) == %#v after %d requests, want %T after %d requests", tc.altitudeReference, err, requests, tc.wantErr, tc.wantRequests)
+		}
+	}
+}
+
+func TestCreateActivityPrivacy(t *testing.T) {
+	var requests int
+	var content string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		f, _, err := r.FormFile("gps_track")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		defer f.Close()
+		data, err := ioutil.ReadAll(f)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		content = string(data)
+		w.Write([]byte(`{"id": 1}`))
+	}))
+	defer ts.Close()
+	ctx := context.Background()
+	zones := []PrivacyZone{{Latitude: 47, Longitude: 13, Radius: 1000}}
+	igc := "AXXX001\r\n" +
+		"HFDTE050715\r\n" +
+		"HFPLTPILOTINCHARGE:Tom Payne\r\n" +
+		"HFGTYGLIDERTYPE:Ozone Enzo\r\n" +
+		"B0930004700000N01300000EA0050000500\r\n" +
+		"B0930014706000N01300000EA0050000500\r\n" +
+		"GABCDEF\r\n"
+
+	client := NewClient(APIURL(ts.URL), Privacy(&PrivacyFilter{Zones: zones}))
+	if _, err := client.CreateActivity(ctx, "track.igc", strings.NewReader(igc)); err != nil {
+		t.Fatalf("client.CreateActivity(...) == ..., %v, want ..., nil", err)
+	}
+	if want := strings.Replace(igc, "B0930004700000N01300000EA0050000500\r\n", "", 1); content != want {
+		t.Errorf("uploaded %q, want %q", content, want)
+	}
+
+	client = NewClient(APIURL(ts.URL), Privacy(&PrivacyFilter{Zones: zones, Jitter: true, Rand: rand.New(rand.NewSource(1))}))
+	if _, err := client.CreateActivity(ctx, "track.igc", strings.NewReader(igc)); err != nil {
+		t.Fatalf("client.CreateActivity(...) == ..., %v, want ..., nil", err)
+	}
+	samples, err := ReadIGC(strings.NewReader(content))
+	if err != nil || len(samples) != 2 || !zones[0].Contains(samples[0].Coords.Latitude, samples[0].Coords.Longitude) || !strings.HasPrefix(content, "AXXX001\r\nHFDTE050715\r\nHFPLTPILOTINCHARGE:Tom Payne\r\n") {
+		t.Errorf("uploaded %q, want headers and a jittered first fix within the zone", content)
+	}
+
+	requests = 0
+	if _, err := client.CreateActivity(ctx, "track.kml", strings.NewReader("track")); !reflect.DeepEqual(err, &ErrPrivacyUnsupported{Filename: "track.kml"}) || requests != 0 {
+		t.Errorf("client.CreateActivity(...) == ..., %v after %d requests, want ..., %v after 0 requests", err, requests, &ErrPrivacyUnsupported{Filename: "track.kml"})
+	}
+
+	client = NewClient(APIURL(ts.URL), Privacy(&PrivacyFilter{}))
+	if _, err := client.CreateActivity(ctx, "track.kml", strings.NewReader("track")); err != nil || content != "track" {
+		t.Errorf("client.CreateActivity(...) with no privacy zones == ..., %v and uploaded %q, want ..., nil and %q", err, content, "track")
+	}
+}
+
+func TestCreateActivityNoLeaks(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Connection", "close")
+		http.Error(w, "bad request", http.StatusBadRequest)
+	}))
+	defer ts.Close()
+	ctx := context.Background()
+	client := NewClient(
+		APIURL(ts.URL),
+		HTTPClient(&http.Client{Transport: &http.Transport{DisableKeepAlives: true}}),
+		Progress(func(string, int64, int64) {}),
+	)
+	before := runtime.NumGoroutine()
+	gpsTrack := strings.NewReader(strings.Repeat("track", 1<<20))
+	for i := 0; i < 20; i++ {
+		if _, err := client.CreateActivity(ctx, "track.igc", gpsTrack); err == nil {
+			t.Fatalf("client.CreateActivity(...) == ..., nil, want ..., non-nil")
+		}
+		gpsTrack.Seek(0, io.SeekStart)
+	}
+	var after int
+	for start := time.Now(); time.Since(start) < time.Second; time.Sleep(10 * time.Millisecond) {
+		if after = runtime.NumGoroutine(); after <= before {
+			return
+		}
+	}
+	t.Errorf("got %d goroutines after failed uploads, want %d", after, before)
+}
+
+func TestCreateActivities(t *testing.T) {
+	var mu sync.Mutex
+	var active, maxActive, nextID int
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/activity" {
+			w.Write([]byte(`{}`))
+			return
+		}
+		mu.Lock()
+		active++
+		if active > maxActive {
+			maxActive = active
+		}
+		mu.Unlock()
+		defer func() {
+			mu.Lock()
+			active--
+			mu.Unlock()
+		}()
+		_, fh, err := r.FormFile("gps_track")
+		if err != nil || fh.Filename == "bad.igc" {
+			http.Error(w, "bad gps_track", http.StatusBadRequest)
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+		mu.Lock()
+		nextID++
+		id := nextID
+		mu.Unlock()
+		fmt.Fprintf(w, `{"id": %d}`, id)
+	}))
+	defer ts.Close()
+	client := NewClient(APIURL(ts.URL))
+	var uploads []Upload
+	for _, filename := range []string{"a.igc", "b.igc", "bad.igc", "c.igc", "d.igc"} {
+		filename := filename
+		uploads = append(uploads, Upload{
+			Filename: filename,
+			Open: func() (io.ReadCloser, error) {
+				return ioutil.NopCloser(strings.NewReader(filename)), nil
+			},
+		})
+	}
+	activities, err := client.CreateActivities(context.Background(), uploads, 2)
+	errUploads, ok := err.(ErrUploads)
+	if !ok || len(errUploads) != 1 || errUploads[0].Filename != "bad.igc" {
+		t.Errorf("client.CreateActivities(...) == ..., %v, want ..., ErrUploads for bad.igc", err)
+	}
+	ids := make(map[int]bool)
+	for i, a := range activities {
+		switch {
+		case uploads[i].Filename == "bad.igc" && a != nil:
+			t.Errorf("activities[%d] == %v, want nil", i, a)
+		case uploads[i].Filename != "bad.igc" && (a == nil || ids[a.ID]):
+			t.Errorf("activities[%d] == %v, want new activity", i, a)
+		case a != nil:
+			ids[a.ID] = true
+		}
+	}
+	if maxActive > 2 {
+		t.Errorf("got %d concurrent uploads, want at most 2", maxActive)
+	}
+}
+
+// A fakeResourceCreator is a ResourceCreator that creates activities in
+// memory.
+type fakeResourceCreator struct {
+	sync.Mutex
+	nextID            int
+	activities        map[int]bool
+	deleteFailures    map[int]int
+	failVisualisation bool
+	cancel            context.CancelFunc
+	reused            map[string]int
+}
+
+func (f *fakeResourceCreator) CreateActivityWithInfo(ctx context.Context, filename string, gpsTrack io.Reader, activityInfo *ActivityInfo) (*Activity, error) {
+	activity, _, err := f.CreateOrReuseActivityWithInfo(ctx, filename, gpsTrack, activityInfo)
+	return activity, err
+}
+
+func (f *fakeResourceCreator) CreateOrReuseActivityWithInfo(ctx context.Context, filename string, gpsTrack io.Reader, activityInfo *ActivityInfo) (*Activity, bool, error) {
+	f.Lock()
+	defer f.Unlock()
+	if id, ok := f.reused[filename]; ok {
+		return &Activity{ID: id}, false, nil
+	}
+	switch filename {
+	case "bad.igc":
+		return nil, false, Error{HTTPStatusCode: http.StatusBadRequest}
+	case "cancel.igc":
+		f.cancel()
+	}
+	f.nextID++
+	f.activities[f.nextID] = true
+	return &Activity{ID: f.nextID}, true, nil
+}
+
+func (f *fakeResourceCreator) CreateVisualisation(ctx context.Context, activities []*Activity) (*Visualisation, error) {
+	if f.failVisualisation {
+		return nil, Error{HTTPStatusCode: http.StatusInternalServerError}
+	}
+	return &Visualisation{Key: "key"}, nil
+}
+
+func (f *fakeResourceCreator) DeleteActivity(ctx context.Context, activity *Activity) error {
+	f.Lock()
+	defer f.Unlock()
+	if f.deleteFailures[activity.ID] != 0 {
+		f.deleteFailures[activity.ID]--
+		return Error{HTTPStatusCode: http.StatusServiceUnavailable}
+	}
+	delete(f.activities, activity.ID)
+	return nil
+}
+
+func TestCreateVisualisationFromTracks(t *testing.T) {
+	rollbackRetryDelay = time.Millisecond
+	for _, tc := range []struct {
+		name              string
+		filenames         []string
+		deleteFailures    map[int]int
+		failVisualisation bool
+		reused            map[string]int
+		wantErr           bool
+		wantLeftovers     []int
+		wantActivities    []int
+	}{
+		{
+			name:           "ok",
+			filenames:      []string{"a.igc", "b.igc"},
+			wantActivities: []int{1, 2},
+		},
+		{
+			name:      "upload_error",
+			filenames: []string{"a.igc", "bad.igc", "c.igc"},
+			wantErr:   true,
+		},
+		{
+			name:              "visualisation_error",
+			filenames:         []string{"a.igc", "b.igc"},
+			failVisualisation: true,
+			wantErr:           true,
+		},
+		{
+			name:              "delete_retried",
+			filenames:         []string{"a.igc", "b.igc"},
+			deleteFailures:    map[int]int{1: rollbackAttempts - 1},
+			failVisualisation: true,
+			wantErr:           true,
+		},
+		{
+			name:              "delete_error",
+			filenames:         []string{"a.igc", "b.igc"},
+			deleteFailures:    map[int]int{2: rollbackAttempts},
+			failVisualisation: true,
+			wantErr:           true,
+			wantLeftovers:     []int{2},
+			wantActivities:    []int{2},
+		},
+		{
+			name:      "cancelled",
+			filenames: []string{"a.igc", "cancel.igc", "c.igc"},
+			wantErr:   true,
+		},
+		{
+			name:              "reused_not_deleted",
+			filenames:         []string{"a.igc", "cached.igc"},
+			reused:            map[string]int{"cached.igc": 100},
+			failVisualisation: true,
+			wantErr:           true,
+			wantActivities:    []int{100},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			f := &fakeResourceCreator{
+				activities:        make(map[int]bool),
+				deleteFailures:    tc.deleteFailures,
+				failVisualisation: tc.failVisualisation,
+				cancel:            cancel,
+				reused:            tc.reused,
+			}
+			for _, id := range tc.reused {
+				f.activities[id] = true
+			}
+			var uploads []Upload
+			for _, filename := range tc.filenames {
+				uploads = append(uploads, Upload{
+					Filename: filename,
+					Open: func() (io.ReadCloser, error) {
+						return ioutil.NopCloser(strings.NewReader("")), nil
+					},
+				})
+			}
+			v, activities, err := CreateVisualisationFromTracks(ctx, f, uploads, 1)
+			if gotErr := err != nil; gotErr != tc.wantErr {
+				t.Errorf("CreateVisualisationFromTracks(...) == %v, %v, %v, want error %t", v, activities, err, tc.wantErr)
+			}
+			if !tc.wantErr && (v == nil || len(activities) != len(uploads)) {
+				t.Errorf("CreateVisualisationFromTracks(...) == %v, %v, %v, want visualisation of %d activities", v, activities, err, len(uploads))
+			}
+			var gotLeftovers []int
+			if errRollback, ok := err.(*ErrRollback); ok {
+				for _, a := range errRollback.Leftovers {
+					gotLeftovers = append(gotLeftovers, a.ID)
+				}
+			}
+			if !reflect.DeepEqual(gotLeftovers, tc.wantLeftovers) {
+				t.Errorf("got leftovers %v, want %v", gotLeftovers, tc.wantLeftovers)
+			}
+			var gotActivities []int
+			for id := range f.activities {
+				gotActivities = append(gotActivities, id)
+			}
+			sort.Ints(gotActivities)
+			if !reflect.DeepEqual(gotActivities, tc.wantActivities) {
+				t.Errorf("got activities %v, want %v", gotActivities, tc.wantActivities)
+			}
+		})
+	}
+}
+
+func TestCreateVisualisationsFromTracks(t *testing.T) {
+	rollbackRetryDelay = time.Millisecond
+	for _, tc := range []struct {
+		name           string
+		groups         [][]string
+		reused         map[string]int
+		wantErr        bool
+		wantErrIndexes []int
+		wantActivities []int
+	}{
+		{
+			name:           "ok",
+			groups:         [][]string{{"a.igc", "b.igc"}, {"c.igc"}},
+			wantActivities: []int{1, 2, 3},
+		},
+		{
+			name:           "later_group_fails",
+			groups:         [][]string{{"a.igc", "b.igc"}, {"c.igc", "bad.igc"}},
+			wantErr:        true,
+			wantErrIndexes: []int{3},
+		},
+		{
+			name:           "reused_kept",
+			groups:         [][]string{{"a.igc", "cached.igc"}, {"bad.igc"}},
+			reused:         map[string]int{"cached.igc": 100},
+			wantErr:        true,
+			wantErrIndexes: []int{2},
+			wantActivities: []int{100},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			f := &fakeResourceCreator{
+				activities: make(map[int]bool),
+				cancel:     cancel,
+				reused:     tc.reused,
+			}
+			for _, id := range tc.reused {
+				f.activities[id] = true
+			}
+			groups := make([][]Upload, len(tc.groups))
+			for i, filenames := range tc.groups {
+				for _, filename := range filenames {
+					groups[i] = append(groups[i], Upload{
+						Filename: filename,
+						Open: func() (io.ReadCloser, error) {
+							return ioutil.NopCloser(strings.NewReader("")), nil
+						},
+					})
+				}
+			}
+			vs, activities, err := CreateVisualisationsFromTracks(ctx, f, groups, 1)
+			if gotErr := err != nil; gotErr != tc.wantErr {
+				t.Errorf("CreateVisualisationsFromTracks(...) == %v, %v, %v, want error %t", vs, activities, err, tc.wantErr)
+			}
+			if !tc.wantErr && (len(vs) != len(groups) || len(activities) != len(groups)) {
+				t.Errorf("CreateVisualisationsFromTracks(...) == %v, %v, %v, want %d visualisations", vs, activities, err, len(groups))
+			}
+			var gotErrIndexes []int
+			if errUploads, ok := err.(ErrUploads); ok {
+				for _, errUpload := range errUploads {
+					gotErrIndexes = append(gotErrIndexes, errUpload.Index)
+				}
+			}
+			if !reflect.DeepEqual(gotErrIndexes, tc.wantErrIndexes) {
+				t.Errorf("got error indexes %v, want %v", gotErrIndexes, tc.wantErrIndexes)
+			}
+			var gotActivities []int
+			for id := range f.activities {
+				gotActivities = append(gotActivities, id)
+			}
+			sort.Ints(gotActivities)
+			if !reflect.DeepEqual(gotActivities, tc.wantActivities) {
+				t.Errorf("got activities %v, want %v", gotActivities, tc.wantActivities)
+			}
+		})
+	}
+}
+
+func TestClientIdentity(t *testing.T) {
+	for _, tc := range []struct {
+		options []ClientOption
+		want    string
+	}{
+		{
+			want: "",
+		},
+		{
+			options: []ClientOption{Anonymous("tom")},
+			want:    "user-id:tom",
+		},
+		{
+			options: []ClientOption{Delegate("secret")},
+			want:    "user-key-sha256:2bb80d537b1da3e38bd30361aa855686bde0eacd7162fef6a25fe97bf527a25b",
+		},
+	} {
+		if got := NewClient(tc.options...).Identity(); got != tc.want {
+			t.Errorf("NewClient(%v...).Identity() == %q, want %q", tc.options, got, tc.want)
+		}
+	}
+}
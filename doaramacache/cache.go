@@ -0,0 +1,414 @@
+package doaramacache
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/cnf/structhash"
+	"github.com/twpayne/go-doarama"
+)
+
+// A store stores cache entries.
+type store interface {
+	// Add adds e unless an entry with the same key already exists, and
+	// returns the stored entry. Any entry with the same scope and activity ID
+	// is replaced. Add is atomic with respect to concurrent calls to Add.
+	Add(context.Context, *Entry) (*Entry, error)
+	// Close releases any resources.
+	Close() error
+	// Delete deletes the entry with the specified scope and activity ID, if
+	// any.
+	Delete(context.Context, scope, int) error
+	// DeleteVisualisation deletes all visualisations with the specified scope
+	// and visualisation key.
+	DeleteVisualisation(context.Context, scope, string) error
+	// DeleteVisualisations deletes all visualisations with the specified
+	// scope of sets of activities containing the specified activity ID.
+	DeleteVisualisations(context.Context, scope, int) error
+	// Entries returns all entries in all scopes, ordered by activity ID.
+	Entries(context.Context) ([]*Entry, error)
+	// Entry returns the entry with the specified scope and activity ID, or
+	// nil.
+	Entry(context.Context, scope, int) (*Entry, error)
+	// Get returns the entry with the specified key, or nil.
+	Get(context.Context, entryKey) (*Entry, error)
+	// GetVisualisation returns the key of the visualisation with the
+	// specified key, or the empty string.
+	GetVisualisation(context.Context, visualisationKey) (string, error)
+	// Put adds an entry, replacing any entry with the same key or the same
+	// scope and activity ID.
+	Put(context.Context, *Entry) error
+	// PutVisualisation adds the key of the visualisation with the specified
+	// key.
+	PutVisualisation(context.Context, visualisationKey, string) error
+}
+
+// A cache is an ActivityCreator, Manager, Verifier, VisualisationCreator, and
+// VisualisationManager that caches activities and visualisations in a store.
+type cache struct {
+	client *doarama.Client
+	config *config
+	store  store
+	group  group
+}
+
+// A call is an in-flight or completed call to group.do.
+type call struct {
+	wg  sync.WaitGroup
+	val interface{}
+	err error
+}
+
+// A group coalesces concurrent calls with the same key so that the function
+// is only called once.
+type group struct {
+	sync.Mutex
+	calls map[string]*call
+}
+
+// do calls f and returns its result, unless a call with the same key is
+// already in flight, in which case it waits for and returns that call's
+// result.
+func (g *group) do(key string, f func() (interface{}, error)) (interface{}, error) {
+	g.Lock()
+	if g.calls == nil {
+		g.calls = make(map[string]*call)
+	}
+	if c, ok := g.calls[key]; ok {
+		g.Unlock()
+		c.wg.Wait()
+		return c.val, c.err
+	}
+	c := &call{}
+	c.wg.Add(1)
+	g.calls[key] = c
+	g.Unlock()
+	c.val, c.err = f()
+	c.wg.Done()
+	g.Lock()
+	delete(g.calls, key)
+	g.Unlock()
+	return c.val, c.err
+}
+
+// newCache returns a new cache of activities created by client in s.
+func newCache(client *doarama.Client, s store, options []Option) *cache {
+	return &cache{
+		client: client,
+		config: newConfig(options),
+		store:  s,
+	}
+}
+
+// Close releases any resources.
+func (c *cache) Close() error {
+	if c != nil {
+		return c.store.Close()
+	}
+	return nil
+}
+
+// A createdActivity is an activity and whether it was newly created.
+type createdActivity struct {
+	activity *doarama.Activity
+	created  bool
+}
+
+// CreateActivityWithInfo creates an activity, re-using a previous activity if
+// available.
+func (c *cache) CreateActivityWithInfo(ctx context.Context, filename string, gpsTrack io.Reader, activityInfo *doarama.ActivityInfo) (*doarama.Activity, error) {
+	activity, _, err := c.CreateOrReuseActivityWithInfo(ctx, filename, gpsTrack, activityInfo)
+	return activity, err
+}
+
+// CreateOrReuseActivityWithInfo implements
+// doarama.ReusingActivityCreator. gpsTrack is spooled to a temporary file
+// while it is hashed, so large tracks are never held in memory, and is only
+// uploaded if it is not cached. Concurrent calls with the same track and
+// activity info result in at most one upload.
+func (c *cache) CreateOrReuseActivityWithInfo(ctx context.Context, filename string, gpsTrack io.Reader, activityInfo *doarama.ActivityInfo) (*doarama.Activity, bool, error) {
+	f, err := ioutil.TempFile("", "doarama-")
+	if err != nil {
+		return nil, false, err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	h := sha256.New()
+	size, err := io.Copy(io.MultiWriter(f, h), gpsTrack)
+	if err != nil {
+		return nil, false, err
+	}
+	gpsTrackSha256 := SHA256(h.Sum(nil))
+	if c.config.normalize {
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return nil, false, err
+		}
+		if samplesSha256 := normalizedSHA256(filename, f); samplesSha256 != nil {
+			gpsTrackSha256 = samplesSha256
+		}
+	}
+	gpsTrackSha256 = c.privacySHA256(gpsTrackSha256)
+	activityInfoSha256 := sha256.Sum256(structhash.Dump(activityInfo, 0))
+	k := entryKey{
+		scope:              c.scope(),
+		GPSTrackSHA256:     gpsTrackSha256,
+		ActivityInfoSHA256: activityInfoSha256[:],
+	}
+	v, err := c.group.do("activity:"+k.String(), func() (interface{}, error) {
+		return c.createActivity(ctx, filename, f, size, k, activityInfo)
+	})
+	if ca := v.(*createdActivity); ca != nil {
+		return ca.activity, ca.created, err
+	}
+	return nil, false, err
+}
+
+// normalizedSHA256 returns the hash of the canonical sequence of samples of
+// the track in r, or nil if r cannot be parsed.
+func normalizedSHA256(filename string, r io.Reader) SHA256 {
+	samples, err := doarama.ReadSamples(filename, r)
+	if err != nil || len(samples) == 0 {
+		return nil
+	}
+	h := sha256.New()
+	io.WriteString(h, "samples-v1\n")
+	for _, s := range samples {
+		for _, x := range []interface{}{int64(s.Time), s.Coords.Latitude, s.Coords.Longitude, s.Coords.Altitude} {
+			binary.Write(h, binary.BigEndian, x)
+		}
+	}
+	return h.Sum(nil)
+}
+
+// privacySHA256 returns gpsTrackSha256 combined with the configuration of the
+// client's privacy filter, so that tracks uploaded with different privacy
+// zones or jitter settings are cached separately. gpsTrackSha256 is returned
+// unchanged if there is no privacy filter.
+func (c *cache) privacySHA256(gpsTrackSha256 SHA256) SHA256 {
+	privacyFilter := c.client.PrivacyFilter()
+	if privacyFilter == nil || len(privacyFilter.Zones) == 0 {
+		return gpsTrackSha256
+	}
+	h := sha256.New()
+	io.WriteString(h, "privacy-v1\n")
+	h.Write(gpsTrackSha256)
+	json.NewEncoder(h).Encode(struct {
+		Zones  []doarama.PrivacyZone
+		Jitter bool
+	}{
+		Zones:  privacyFilter.Zones,
+		Jitter: privacyFilter.Jitter,
+	})
+	return h.Sum(nil)
+}
+
+// scope returns the scope of activities and visualisations created by c's
+// client.
+func (c *cache) scope() scope {
+	return scope{
+		APIURL:  c.client.APIURL(),
+		APIName: c.client.APIName(),
+		User:    c.client.Identity(),
+	}
+}
+
+// createActivity creates an activity from the size bytes spooled in f with key
+// k, re-using a previous activity if available. If another process creates
+// the same activity concurrently then the duplicate is deleted and the other
+// activity is returned as re-used.
+func (c *cache) createActivity(ctx context.Context, filename string, f *os.File, size int64, k entryKey, activityInfo *doarama.ActivityInfo) (*createdActivity, error) {
+	e, err := c.store.Get(ctx, k)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now().UTC()
+	if e != nil && e.expired(now) {
+		if err := c.store.Delete(ctx, k.scope, e.ActivityID); err != nil {
+			return nil, err
+		}
+		e = nil
+	}
+	if e != nil && c.config.verify {
+		ok, err := exists(ctx, c.client.Activity(e.ActivityID))
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			if err := c.evict(ctx, k.scope, e.ActivityID); err != nil {
+				return nil, err
+			}
+			e = nil
+		}
+	}
+	if e != nil {
+		return &createdActivity{activity: c.client.Activity(e.ActivityID)}, nil
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	activity, err := c.client.CreateActivityWithInfo(ctx, filename, f, activityInfo)
+	if err != nil {
+		return nil, err
+	}
+	e = &Entry{
+		ActivityID:         activity.ID,
+		GPSTrackSHA256:     k.GPSTrackSHA256,
+		ActivityInfoSHA256: k.ActivityInfoSHA256,
+		Filename:           filepath.Base(filename),
+		Size:               size,
+		Created:            now,
+		APIURL:             k.APIURL,
+		APIName:            k.APIName,
+		User:               k.User,
+	}
+	if c.config.ttl > 0 {
+		e.Expires = now.Add(c.config.ttl)
+	}
+	e, err = c.store.Add(ctx, e)
+	if err != nil {
+		return &createdActivity{activity: activity, created: true}, err
+	}
+	if e.ActivityID != activity.ID {
+		if err := activity.Delete(ctx); err != nil && !doarama.IsNotFound(err) {
+			return nil, err
+		}
+		return &createdActivity{activity: c.client.Activity(e.ActivityID)}, nil
+	}
+	return &createdActivity{activity: activity, created: true}, nil
+}
+
+// CreateVisualisation creates a visualisation, re-using a previous
+// visualisation of the same set of activities if available.
+func (c *cache) CreateVisualisation(ctx context.Context, activities []*doarama.Activity) (*doarama.Visualisation, error) {
+	activityIDs := make([]int, len(activities))
+	for i, a := range activities {
+		activityIDs[i] = a.ID
+	}
+	k := visualisationKey{
+		scope:       c.scope(),
+		ActivityIDs: activityIDsKey(activityIDs),
+	}
+	v, err := c.group.do("visualisation:"+k.String(), func() (interface{}, error) {
+		return c.createVisualisation(ctx, k, activities)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v.(*doarama.Visualisation), nil
+}
+
+// createVisualisation creates a visualisation of activities with key k,
+// re-using a previous visualisation if available.
+func (c *cache) createVisualisation(ctx context.Context, k visualisationKey, activities []*doarama.Activity) (*doarama.Visualisation, error) {
+	key, err := c.store.GetVisualisation(ctx, k)
+	if err != nil {
+		return nil, err
+	}
+	if key != "" {
+		return c.client.Visualisation(key), nil
+	}
+	v, err := c.client.CreateVisualisation(ctx, activities)
+	if err != nil {
+		return nil, err
+	}
+	return v, c.store.PutVisualisation(ctx, k, v.Key)
+}
+
+// AddActivities implements VisualisationManager. v is removed from the cache
+// as it no longer visualises the same set of activities.
+func (c *cache) AddActivities(ctx context.Context, v *doarama.Visualisation, activities []*doarama.Activity) error {
+	if err := v.AddActivities(ctx, activities); err != nil {
+		return err
+	}
+	return c.store.DeleteVisualisation(ctx, c.scope(), v.Key)
+}
+
+// DeleteVisualisation implements VisualisationManager.
+func (c *cache) DeleteVisualisation(ctx context.Context, v *doarama.Visualisation) error {
+	if err := v.Delete(ctx); err != nil && !doarama.IsNotFound(err) {
+		return err
+	}
+	return c.store.DeleteVisualisation(ctx, c.scope(), v.Key)
+}
+
+// RemoveActivities implements VisualisationManager. v is removed from the
+// cache as it no longer visualises the same set of activities.
+func (c *cache) RemoveActivities(ctx context.Context, v *doarama.Visualisation, activities []*doarama.Activity) error {
+	if err := v.RemoveActivities(ctx, activities); err != nil {
+		return err
+	}
+	return c.store.DeleteVisualisation(ctx, c.scope(), v.Key)
+}
+
+// evict removes the activity with the specified scope and ID, and all
+// visualisations containing it, from the cache.
+func (c *cache) evict(ctx context.Context, s scope, activityID int) error {
+	if err := c.store.Delete(ctx, s, activityID); err != nil {
+		return err
+	}
+	return c.store.DeleteVisualisations(ctx, s, activityID)
+}
+
+// DeleteActivity deletes activity from the server and from the cache.
+func (c *cache) DeleteActivity(ctx context.Context, activity *doarama.Activity) error {
+	if err := activity.Delete(ctx); err != nil && !doarama.IsNotFound(err) {
+		return err
+	}
+	return c.evict(ctx, c.scope(), activity.ID)
+}
+
+// DeleteEntry implements Manager.
+func (c *cache) DeleteEntry(ctx context.Context, e *Entry) error {
+	return c.evict(ctx, e.scope(), e.ActivityID)
+}
+
+// Entries implements Manager.
+func (c *cache) Entries(ctx context.Context) ([]*Entry, error) {
+	return c.store.Entries(ctx)
+}
+
+// Entry implements Manager.
+func (c *cache) Entry(ctx context.Context, activityID int) (*Entry, error) {
+	return c.store.Entry(ctx, c.scope(), activityID)
+}
+
+// PutEntry implements Manager.
+func (c *cache) PutEntry(ctx context.Context, e *Entry) error {
+	return c.store.Put(ctx, e)
+}
+
+// Verify implements Verifier. Only activities created by c's client's API
+// endpoint and user are verified, as the client cannot see others.
+func (c *cache) Verify(ctx context.Context) ([]int, error) {
+	entries, err := c.store.Entries(ctx)
+	if err != nil {
+		return nil, err
+	}
+	s := c.scope()
+	var evicted []int
+	for _, e := range entries {
+		if e.scope() != s {
+			continue
+		}
+		ok, err := exists(ctx, c.client.Activity(e.ActivityID))
+		if err != nil {
+			return evicted, err
+		}
+		if ok {
+			continue
+		}
+		if err := c.evict(ctx, s, e.ActivityID); err != nil {
+			return evicted, err
+		}
+		evicted = append(evicted, e.ActivityID)
+	}
+	return evicted, nil
+}
@@ -0,0 +1,359 @@
+package doaramacache
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/twpayne/go-doarama"
+)
+
+type dir struct {
+	name string
+}
+
+// A dirVisualisation is a cached visualisation in a dir.
+type dirVisualisation struct {
+	APIURL      string `json:"apiUrl,omitempty"`
+	APIName     string `json:"apiName,omitempty"`
+	User        string `json:"user,omitempty"`
+	ActivityIDs string `json:"activityIds"`
+	Key         string `json:"key"`
+}
+
+// scope returns v's scope.
+func (v *dirVisualisation) scope() scope {
+	return scope{
+		APIURL:  v.APIURL,
+		APIName: v.APIName,
+		User:    v.User,
+	}
+}
+
+// NewDir returns a new ActivityCreator that caches activities from client in
+// directory name, with one JSON file per cached activity or visualisation.
+// Writes are atomic and serialized between processes with a lock file, except
+// on Plan 9, where they are only serialized within a process. The returned
+// ActivityCreator also implements Manager, Verifier, and VisualisationCreator.
+func NewDir(name string, client *doarama.Client, options ...Option) (ActivityCreator, error) {
+	if err := os.MkdirAll(filepath.Join(name, "visualisations"), 0700); err != nil {
+		return nil, err
+	}
+	d := &dir{
+		name: name,
+	}
+	if err := d.migrate(); err != nil {
+		return nil, err
+	}
+	return newCache(client, d, options), nil
+}
+
+// filename returns the filename of the entry with key k.
+func (d *dir) filename(k entryKey) string {
+	return filepath.Join(d.name, k.String()+".json")
+}
+
+// visualisationFilename returns the filename of the visualisation with key k.
+func (d *dir) visualisationFilename(k visualisationKey) string {
+	return filepath.Join(d.name, "visualisations", k.String()+".json")
+}
+
+// migrate renames entries written with an earlier naming scheme.
+func (d *dir) migrate() (err error) {
+	unlock, err := d.lock()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if unlockErr := unlock(); err == nil {
+			err = unlockErr
+		}
+	}()
+	entries, filenames, err := d.entries()
+	if err != nil {
+		return err
+	}
+	for i, e := range entries {
+		if filename := d.filename(e.key()); filenames[i] != filename {
+			if err := os.Rename(filenames[i], filename); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// lock acquires the lock on d and returns a function that releases it.
+func (d *dir) lock() (func() error, error) {
+	return lockFile(filepath.Join(d.name, ".lock"))
+}
+
+// read reads the entry in filename, returning nil if it does not exist.
+func (d *dir) read(filename string) (*Entry, error) {
+	data, err := ioutil.ReadFile(filename)
+	switch {
+	case os.IsNotExist(err):
+		return nil, nil
+	case err != nil:
+		return nil, err
+	}
+	e := &Entry{}
+	if err := json.Unmarshal(data, e); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// write atomically writes v as JSON to filename.
+func (d *dir) write(filename string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(d.name, ".tmp-")
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), filename)
+}
+
+// entries returns all entries and their filenames.
+func (d *dir) entries() ([]*Entry, []string, error) {
+	infos, err := ioutil.ReadDir(d.name)
+	if err != nil {
+		return nil, nil, err
+	}
+	var entries []*Entry
+	var filenames []string
+	for _, info := range infos {
+		if info.IsDir() || strings.HasPrefix(info.Name(), ".") || filepath.Ext(info.Name()) != ".json" {
+			continue
+		}
+		filename := filepath.Join(d.name, info.Name())
+		e, err := d.read(filename)
+		if err != nil {
+			return nil, nil, err
+		}
+		if e == nil {
+			continue
+		}
+		entries = append(entries, e)
+		filenames = append(filenames, filename)
+	}
+	return entries, filenames, nil
+}
+
+// delete deletes the entry with the specified scope and activity ID. d must be
+// locked.
+func (d *dir) delete(s scope, activityID int) error {
+	entries, filenames, err := d.entries()
+	if err != nil {
+		return err
+	}
+	for i, e := range entries {
+		if e.scope() != s || e.ActivityID != activityID {
+			continue
+		}
+		if err := os.Remove(filenames[i]); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// Add implements store.
+func (d *dir) Add(ctx context.Context, e *Entry) (_ *Entry, err error) {
+	unlock, err := d.lock()
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if unlockErr := unlock(); err == nil {
+			err = unlockErr
+		}
+	}()
+	filename := d.filename(e.key())
+	existing, err := d.read(filename)
+	if err != nil {
+		return nil, err
+	}
+	if existing != nil {
+		return existing, nil
+	}
+	if err := d.delete(e.scope(), e.ActivityID); err != nil {
+		return nil, err
+	}
+	return e, d.write(filename, e)
+}
+
+// Close implements store.
+func (d *dir) Close() error {
+	return nil
+}
+
+// Delete implements store.
+func (d *dir) Delete(ctx context.Context, s scope, activityID int) (err error) {
+	unlock, err := d.lock()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if unlockErr := unlock(); err == nil {
+			err = unlockErr
+		}
+	}()
+	return d.delete(s, activityID)
+}
+
+// deleteVisualisations deletes all visualisations in scope s for which f
+// returns true.
+func (d *dir) deleteVisualisations(s scope, f func(*dirVisualisation) bool) (err error) {
+	unlock, err := d.lock()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if unlockErr := unlock(); err == nil {
+			err = unlockErr
+		}
+	}()
+	filenames, err := filepath.Glob(filepath.Join(d.name, "visualisations", "*.json"))
+	if err != nil {
+		return err
+	}
+	for _, filename := range filenames {
+		data, err := ioutil.ReadFile(filename)
+		if err != nil {
+			return err
+		}
+		var v dirVisualisation
+		if err := json.Unmarshal(data, &v); err != nil {
+			return err
+		}
+		if v.scope() != s || !f(&v) {
+			continue
+		}
+		if err := os.Remove(filename); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// DeleteVisualisation implements store.
+func (d *dir) DeleteVisualisation(ctx context.Context, s scope, key string) error {
+	return d.deleteVisualisations(s, func(v *dirVisualisation) bool {
+		return v.Key == key
+	})
+}
+
+// DeleteVisualisations implements store.
+func (d *dir) DeleteVisualisations(ctx context.Context, s scope, activityID int) error {
+	id := "," + strconv.Itoa(activityID) + ","
+	return d.deleteVisualisations(s, func(v *dirVisualisation) bool {
+		return strings.Contains(v.ActivityIDs, id)
+	})
+}
+
+// Entries implements store.
+func (d *dir) Entries(ctx context.Context) ([]*Entry, error) {
+	entries, _, err := d.entries()
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].ActivityID < entries[j].ActivityID
+	})
+	return entries, nil
+}
+
+// Entry implements store.
+func (d *dir) Entry(ctx context.Context, s scope, activityID int) (*Entry, error) {
+	entries, _, err := d.entries()
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		if e.scope() == s && e.ActivityID == activityID {
+			return e, nil
+		}
+	}
+	return nil, nil
+}
+
+// Get implements store.
+func (d *dir) Get(ctx context.Context, k entryKey) (*Entry, error) {
+	return d.read(d.filename(k))
+}
+
+// GetVisualisation implements store.
+func (d *dir) GetVisualisation(ctx context.Context, k visualisationKey) (string, error) {
+	data, err := ioutil.ReadFile(d.visualisationFilename(k))
+	switch {
+	case os.IsNotExist(err):
+		return "", nil
+	case err != nil:
+		return "", err
+	}
+	var v dirVisualisation
+	if err := json.Unmarshal(data, &v); err != nil {
+		return "", err
+	}
+	return v.Key, nil
+}
+
+// Put implements store.
+func (d *dir) Put(ctx context.Context, e *Entry) (err error) {
+	unlock, err := d.lock()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if unlockErr := unlock(); err == nil {
+			err = unlockErr
+		}
+	}()
+	if err := d.delete(e.scope(), e.ActivityID); err != nil {
+		return err
+	}
+	return d.write(d.filename(e.key()), e)
+}
+
+// PutVisualisation implements store.
+func (d *dir) PutVisualisation(ctx context.Context, k visualisationKey, key string) (err error) {
+	unlock, err := d.lock()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if unlockErr := unlock(); err == nil {
+			err = unlockErr
+		}
+	}()
+	return d.write(d.visualisationFilename(k), &dirVisualisation{
+		APIURL:      k.APIURL,
+		APIName:     k.APIName,
+		User:        k.User,
+		ActivityIDs: k.ActivityIDs,
+		Key:         key,
+	})
+}
@@ -3,7 +3,13 @@ package doaramacache
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/twpayne/go-doarama"
 )
@@ -15,4 +21,225 @@ type ActivityCreator interface {
 	// CreateActivityWithInfo creates a new doarama.Activity with the specified
 	// doarama.ActivityInfo.
 	CreateActivityWithInfo(context.Context, string, io.Reader, *doarama.ActivityInfo) (*doarama.Activity, error)
+	// DeleteActivity deletes a doarama.Activity.
+	DeleteActivity(context.Context, *doarama.Activity) error
+}
+
+// A VisualisationCreator can create visualisations.
+type VisualisationCreator interface {
+	// Close releases any resources.
+	Close() error
+	// CreateVisualisation creates a new doarama.Visualisation of the specified
+	// activities.
+	CreateVisualisation(context.Context, []*doarama.Activity) (*doarama.Visualisation, error)
+}
+
+// A VisualisationManager can change and delete visualisations.
+type VisualisationManager interface {
+	// AddActivities adds activities to a doarama.Visualisation.
+	AddActivities(context.Context, *doarama.Visualisation, []*doarama.Activity) error
+	// DeleteVisualisation deletes a doarama.Visualisation.
+	DeleteVisualisation(context.Context, *doarama.Visualisation) error
+	// RemoveActivities removes activities from a doarama.Visualisation.
+	RemoveActivities(context.Context, *doarama.Visualisation, []*doarama.Activity) error
+}
+
+// A Verifier can verify that cached activities still exist.
+type Verifier interface {
+	// Verify checks that every cached activity still exists on the server,
+	// evicts those that do not, and returns the IDs of the evicted
+	// activities.
+	Verify(context.Context) ([]int, error)
+}
+
+// A Manager can inspect and maintain cached activities.
+type Manager interface {
+	// DeleteEntry removes a cached activity from the cache without deleting
+	// it from the server.
+	DeleteEntry(context.Context, *Entry) error
+	// Entries returns all cached activities, for all API endpoints and users.
+	Entries(context.Context) ([]*Entry, error)
+	// Entry returns the cached activity with the specified ID created by the
+	// cache's client's API endpoint and user, or nil if it is not cached.
+	Entry(context.Context, int) (*Entry, error)
+	// PutEntry adds a cached activity.
+	PutEntry(context.Context, *Entry) error
+}
+
+// A SHA256 is a SHA256 hash. It is represented as hex in text.
+type SHA256 []byte
+
+// An Entry is a cached activity.
+type Entry struct {
+	ActivityID         int       `json:"activityId"`
+	GPSTrackSHA256     SHA256    `json:"gpsTrackSha256"`
+	ActivityInfoSHA256 SHA256    `json:"activityInfoSha256"`
+	Filename           string    `json:"filename,omitempty"`
+	Size               int64     `json:"size,omitempty"`
+	Created            time.Time `json:"created"`
+	APIURL             string    `json:"apiUrl,omitempty"`
+	APIName            string    `json:"apiName,omitempty"`
+	User               string    `json:"user,omitempty"`
+	Expires            time.Time `json:"expires"`
+}
+
+// A scope identifies the API endpoint and user that activities and
+// visualisations are created under. Activity IDs and visualisation keys are
+// only re-used within the same scope.
+type scope struct {
+	APIURL  string
+	APIName string
+	User    string
+}
+
+// An entryKey identifies a cached activity.
+type entryKey struct {
+	scope
+	GPSTrackSHA256     SHA256
+	ActivityInfoSHA256 SHA256
+}
+
+// A visualisationKey identifies a cached visualisation.
+type visualisationKey struct {
+	scope
+	ActivityIDs string
+}
+
+// An Option sets an option on a cache.
+type Option func(*config)
+
+type config struct {
+	normalize bool
+	ttl       time.Duration
+	verify    bool
+}
+
+// Normalize sets whether tracks are identified by their samples rather than
+// their raw bytes. When set, tracks in a known format are parsed and the
+// canonical sequence of samples is hashed, so the same track re-exported with
+// different line endings, headers, or attribute order re-uses the cached
+// activity. Tracks that cannot be parsed are identified by their raw bytes.
+func Normalize(normalize bool) Option {
+	return func(c *config) {
+		c.normalize = normalize
+	}
+}
+
+// TTL sets the time after which newly cached activities expire. Expired
+// activities are created again rather than re-used. Zero, the default, means
+// that cached activities never expire.
+func TTL(ttl time.Duration) Option {
+	return func(c *config) {
+		c.ttl = ttl
+	}
+}
+
+// Verify sets whether cached activities are checked to still exist on the
+// server before they are re-used. Activities that no longer exist are evicted
+// and created again.
+func Verify(verify bool) Option {
+	return func(c *config) {
+		c.verify = verify
+	}
+}
+
+// activityIDsKey returns the key for the set of activity IDs.
+func activityIDsKey(activityIDs []int) string {
+	sorted := make([]int, len(activityIDs))
+	copy(sorted, activityIDs)
+	sort.Ints(sorted)
+	var b strings.Builder
+	b.WriteByte(',')
+	for i, id := range sorted {
+		if i > 0 && id == sorted[i-1] {
+			continue
+		}
+		b.WriteString(strconv.Itoa(id))
+		b.WriteByte(',')
+	}
+	return b.String()
+}
+
+// newConfig returns the config set by options.
+func newConfig(options []Option) *config {
+	c := &config{}
+	for _, option := range options {
+		option(c)
+	}
+	return c
+}
+
+// hashStrings returns the hex SHA256 of ss, separated by NUL bytes.
+func hashStrings(ss ...string) string {
+	h := sha256.New()
+	for _, s := range ss {
+		io.WriteString(h, s)
+		h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// key returns e's key.
+func (e *Entry) key() entryKey {
+	return entryKey{
+		scope:              e.scope(),
+		GPSTrackSHA256:     e.GPSTrackSHA256,
+		ActivityInfoSHA256: e.ActivityInfoSHA256,
+	}
+}
+
+// scope returns e's scope.
+func (e *Entry) scope() scope {
+	return scope{
+		APIURL:  e.APIURL,
+		APIName: e.APIName,
+		User:    e.User,
+	}
+}
+
+// expired returns whether e has expired at now.
+func (e *Entry) expired(now time.Time) bool {
+	return !e.Expires.IsZero() && !now.Before(e.Expires)
+}
+
+// String returns a string that uniquely identifies k.
+func (k entryKey) String() string {
+	return hashStrings(k.APIURL, k.APIName, k.User, k.GPSTrackSHA256.String(), k.ActivityInfoSHA256.String())
+}
+
+// String returns a string that uniquely identifies k.
+func (k visualisationKey) String() string {
+	return hashStrings(k.APIURL, k.APIName, k.User, k.ActivityIDs)
+}
+
+// exists returns whether activity still exists on the server.
+func exists(ctx context.Context, activity *doarama.Activity) (bool, error) {
+	switch _, err := activity.Info(ctx); {
+	case err == nil:
+		return true, nil
+	case doarama.IsNotFound(err):
+		return false, nil
+	default:
+		return false, err
+	}
+}
+
+// MarshalText implements encoding.TextMarshaler.
+func (h SHA256) MarshalText() ([]byte, error) {
+	return []byte(h.String()), nil
+}
+
+// String returns h as hex.
+func (h SHA256) String() string {
+	return hex.EncodeToString(h)
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler.
+func (h *SHA256) UnmarshalText(text []byte) error {
+	b, err := hex.DecodeString(string(text))
+	if err != nil {
+		return err
+	}
+	*h = b
+	return nil
 }
@@ -0,0 +1,789 @@
+package doaramacache
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/twpayne/go-doarama"
+)
+
+// A fakeServer is a minimal fake Doarama API server.
+type fakeServer struct {
+	sync.Mutex
+	nextID             int
+	activities         map[int]bool
+	uploads            int
+	visualisations     int
+	failVisualisations bool
+}
+
+func newFakeServer() *fakeServer {
+	return &fakeServer{
+		nextID:     1,
+		activities: make(map[int]bool),
+	}
+}
+
+func (s *fakeServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.Lock()
+	defer s.Unlock()
+	if r.Method == "POST" && r.URL.Path == "/activity" {
+		if _, _, err := r.FormFile("gps_track"); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		id := s.nextID
+		s.nextID++
+		s.activities[id] = true
+		s.uploads++
+		fmt.Fprintf(w, `{"id": %d}`, id)
+		return
+	}
+	if r.Method == "POST" && r.URL.Path == "/visualisation" {
+		if s.failVisualisations {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		s.visualisations++
+		fmt.Fprintf(w, `{"key": "v%d"}`, s.visualisations)
+		return
+	}
+	if r.Method == "POST" && (r.URL.Path == "/visualisation/addActivities" || r.URL.Path == "/visualisation/removeActivities") ||
+		r.Method == "DELETE" && strings.HasPrefix(r.URL.Path, "/visualisation/") {
+		fmt.Fprint(w, `{}`)
+		return
+	}
+	id, err := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/activity/"))
+	if err != nil || !s.activities[id] {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method == "DELETE" {
+		delete(s.activities, id)
+	}
+	fmt.Fprint(w, `{}`)
+}
+
+func (s *fakeServer) getUploads() int {
+	s.Lock()
+	defer s.Unlock()
+	return s.uploads
+}
+
+func (s *fakeServer) getActivities() int {
+	s.Lock()
+	defer s.Unlock()
+	return len(s.activities)
+}
+
+func (s *fakeServer) getVisualisations() int {
+	s.Lock()
+	defer s.Unlock()
+	return s.visualisations
+}
+
+func (s *fakeServer) setFailVisualisations(failVisualisations bool) {
+	s.Lock()
+	defer s.Unlock()
+	s.failVisualisations = failVisualisations
+}
+
+// A backend creates ActivityCreators for testing.
+type backend struct {
+	name       string
+	persistent bool
+	new        func(t *testing.T, dir string, client *doarama.Client, options ...Option) ActivityCreator
+}
+
+var backends = []backend{
+	{
+		name: "memory",
+		new: func(t *testing.T, dir string, client *doarama.Client, options ...Option) ActivityCreator {
+			return NewMemory(client, options...)
+		},
+	},
+	{
+		name:       "dir",
+		persistent: true,
+		new: func(t *testing.T, dir string, client *doarama.Client, options ...Option) ActivityCreator {
+			ac, err := NewDir(filepath.Join(dir, "cache"), client, options...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return ac
+		},
+	},
+	{
+		name:       "sqlite3",
+		persistent: true,
+		new: func(t *testing.T, dir string, client *doarama.Client, options ...Option) ActivityCreator {
+			ac, err := NewSQLite3(filepath.Join(dir, "cache.sqlite3"), client, options...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return ac
+		},
+	},
+}
+
+func mustCreate(t *testing.T, ac ActivityCreator, gpsTrack string, activityInfo *doarama.ActivityInfo) int {
+	t.Helper()
+	a, err := ac.CreateActivityWithInfo(context.Background(), "track.igc", strings.NewReader(gpsTrack), activityInfo)
+	if err != nil {
+		t.Fatalf("ac.CreateActivityWithInfo(...) == %v, %v, want ..., nil", a, err)
+	}
+	return a.ID
+}
+
+func activityIDs(t *testing.T, m Manager) []int {
+	t.Helper()
+	entries, err := m.Entries(context.Background())
+	if err != nil {
+		t.Fatalf("m.Entries(...) == ..., %v, want ..., nil", err)
+	}
+	var ids []int
+	for _, e := range entries {
+		ids = append(ids, e.ActivityID)
+	}
+	return ids
+}
+
+func TestConformance(t *testing.T) {
+	for _, b := range backends {
+		t.Run(b.name, func(t *testing.T) {
+			testConformance(t, b)
+		})
+	}
+}
+
+func testConformance(t *testing.T, b backend) {
+	ctx := context.Background()
+	s := newFakeServer()
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+	client := doarama.NewClient(doarama.APIURL(ts.URL), doarama.Anonymous("tom"))
+	dir := t.TempDir()
+	ac := b.new(t, dir, client)
+	defer ac.Close()
+	m := ac.(Manager)
+	info1 := &doarama.ActivityInfo{TypeID: doarama.FlyParaglide}
+	info2 := &doarama.ActivityInfo{TypeID: doarama.FlyHangGlide}
+
+	id1 := mustCreate(t, ac, "track A", info1)
+	if got := mustCreate(t, ac, "track A", info1); got != id1 || s.getUploads() != 1 {
+		t.Errorf("second create returned %d after %d uploads, want %d after 1 upload", got, s.getUploads(), id1)
+	}
+	id2 := mustCreate(t, ac, "track A", info2)
+	id3 := mustCreate(t, ac, "track B", info1)
+	if id2 == id1 || id3 == id1 || id3 == id2 || s.getUploads() != 3 {
+		t.Errorf("got ids %d, %d, %d after %d uploads, want distinct ids after 3 uploads", id1, id2, id3, s.getUploads())
+	}
+	if got, want := activityIDs(t, m), []int{id1, id2, id3}; !reflect.DeepEqual(got, want) {
+		t.Errorf("activityIDs(...) == %v, want %v", got, want)
+	}
+
+	e, err := m.Entry(ctx, id1)
+	if err != nil || e == nil {
+		t.Fatalf("m.Entry(ctx, %d) == %v, %v, want non-nil, nil", id1, e, err)
+	}
+	if e.Filename != "track.igc" || e.Size != int64(len("track A")) || e.Created.IsZero() || e.APIURL != ts.URL || e.User != "user-id:tom" {
+		t.Errorf("m.Entry(ctx, %d) == %#v, want complete metadata", id1, e)
+	}
+	if e, err := m.Entry(ctx, 999); err != nil || e != nil {
+		t.Errorf("m.Entry(ctx, 999) == %v, %v, want nil, nil", e, err)
+	}
+
+	if err := ac.DeleteActivity(ctx, client.Activity(id1)); err != nil {
+		t.Errorf("ac.DeleteActivity(ctx, %d) == %v, want nil", id1, err)
+	}
+	id4 := mustCreate(t, ac, "track A", info1)
+	if id4 == id1 || s.getUploads() != 4 {
+		t.Errorf("create after delete returned %d after %d uploads, want new id after 4 uploads", id4, s.getUploads())
+	}
+
+	if err := client.Activity(id2).Delete(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := ac.(Verifier).Verify(ctx); err != nil || !reflect.DeepEqual(got, []int{id2}) {
+		t.Errorf("ac.Verify(ctx) == %v, %v, want %v, nil", got, err, []int{id2})
+	}
+	if got, want := activityIDs(t, m), []int{id3, id4}; !reflect.DeepEqual(got, want) {
+		t.Errorf("activityIDs(...) == %v, want %v", got, want)
+	}
+
+	e3, err := m.Entry(ctx, id3)
+	if err != nil || e3 == nil {
+		t.Fatalf("m.Entry(ctx, %d) == %v, %v, want non-nil, nil", id3, e3, err)
+	}
+	if err := m.DeleteEntry(ctx, e3); err != nil {
+		t.Errorf("m.DeleteEntry(ctx, %#v) == %v, want nil", e3, err)
+	}
+	imported := &Entry{ActivityID: 100, GPSTrackSHA256: SHA256{1}, ActivityInfoSHA256: SHA256{2}, APIURL: ts.URL, User: "user-id:tom"}
+	if err := m.PutEntry(ctx, imported); err != nil {
+		t.Errorf("m.PutEntry(ctx, %#v) == %v, want nil", imported, err)
+	}
+	if got, err := m.Entry(ctx, 100); err != nil || !reflect.DeepEqual(got, imported) {
+		t.Errorf("m.Entry(ctx, 100) == %#v, %v, want %#v, nil", got, err, imported)
+	}
+	if got, want := activityIDs(t, m), []int{id4, 100}; !reflect.DeepEqual(got, want) {
+		t.Errorf("activityIDs(...) == %v, want %v", got, want)
+	}
+
+	if !b.persistent {
+		return
+	}
+	if err := ac.Close(); err != nil {
+		t.Fatalf("ac.Close() == %v, want nil", err)
+	}
+	ac = b.new(t, dir, client)
+	if got := mustCreate(t, ac, "track A", info1); got != id4 || s.getUploads() != 4 {
+		t.Errorf("create after reopen returned %d after %d uploads, want %d after 4 uploads", got, s.getUploads(), id4)
+	}
+}
+
+func TestVerifyOption(t *testing.T) {
+	for _, b := range backends {
+		t.Run(b.name, func(t *testing.T) {
+			ctx := context.Background()
+			s := newFakeServer()
+			ts := httptest.NewServer(s)
+			defer ts.Close()
+			client := doarama.NewClient(doarama.APIURL(ts.URL))
+			ac := b.new(t, t.TempDir(), client, Verify(true))
+			defer ac.Close()
+			info := &doarama.ActivityInfo{TypeID: doarama.FlyParaglide}
+			id1 := mustCreate(t, ac, "track", info)
+			if err := client.Activity(id1).Delete(ctx); err != nil {
+				t.Fatal(err)
+			}
+			if id2 := mustCreate(t, ac, "track", info); id2 == id1 || s.getUploads() != 2 {
+				t.Errorf("create after server delete returned %d after %d uploads, want new id after 2 uploads", id2, s.getUploads())
+			}
+		})
+	}
+}
+
+func TestVisualisationCreator(t *testing.T) {
+	for _, b := range backends {
+		t.Run(b.name, func(t *testing.T) {
+			ctx := context.Background()
+			s := newFakeServer()
+			ts := httptest.NewServer(s)
+			defer ts.Close()
+			client := doarama.NewClient(doarama.APIURL(ts.URL))
+			dir := t.TempDir()
+			ac := b.new(t, dir, client)
+			defer func() {
+				ac.Close()
+			}()
+			info := &doarama.ActivityInfo{TypeID: doarama.FlyParaglide}
+			a1 := client.Activity(mustCreate(t, ac, "track A", info))
+			a2 := client.Activity(mustCreate(t, ac, "track B", info))
+			a3 := client.Activity(mustCreate(t, ac, "track C", info))
+			for _, tc := range []struct {
+				activities []*doarama.Activity
+				wantKey    string
+				wantCount  int
+			}{
+				{activities: []*doarama.Activity{a1, a2}, wantKey: "v1", wantCount: 1},
+				{activities: []*doarama.Activity{a2, a1}, wantKey: "v1", wantCount: 1},
+				{activities: []*doarama.Activity{a1, a2, a1}, wantKey: "v1", wantCount: 1},
+				{activities: []*doarama.Activity{a1, a3}, wantKey: "v2", wantCount: 2},
+			} {
+				v, err := ac.(VisualisationCreator).CreateVisualisation(ctx, tc.activities)
+				if err != nil || v.Key != tc.wantKey || s.getVisualisations() != tc.wantCount {
+					t.Errorf("ac.CreateVisualisation(ctx, %v) == %v, %v after %d visualisations, want key %q, nil after %d visualisations", tc.activities, v, err, s.getVisualisations(), tc.wantKey, tc.wantCount)
+				}
+			}
+			if err := ac.DeleteActivity(ctx, a2); err != nil {
+				t.Fatal(err)
+			}
+			a4 := client.Activity(mustCreate(t, ac, "track B", info))
+			if v, err := ac.(VisualisationCreator).CreateVisualisation(ctx, []*doarama.Activity{a1, a4}); err != nil || v.Key != "v3" {
+				t.Errorf("ac.CreateVisualisation(...) after delete == %v, %v, want key %q, nil", v, err, "v3")
+			}
+			if b.persistent {
+				if err := ac.Close(); err != nil {
+					t.Fatal(err)
+				}
+				ac = b.new(t, dir, client)
+			}
+			if v, err := ac.(VisualisationCreator).CreateVisualisation(ctx, []*doarama.Activity{a3, a1}); err != nil || v.Key != "v2" {
+				t.Errorf("ac.CreateVisualisation(...) == %v, %v, want key %q, nil", v, err, "v2")
+			}
+			if got := s.getVisualisations(); got != 3 {
+				t.Errorf("got %d visualisations, want 3", got)
+			}
+		})
+	}
+}
+
+func TestVisualisationManager(t *testing.T) {
+	for _, b := range backends {
+		t.Run(b.name, func(t *testing.T) {
+			ctx := context.Background()
+			s := newFakeServer()
+			ts := httptest.NewServer(s)
+			defer ts.Close()
+			client := doarama.NewClient(doarama.APIURL(ts.URL))
+			ac := b.new(t, t.TempDir(), client)
+			defer ac.Close()
+			vc := ac.(VisualisationCreator)
+			vm := ac.(VisualisationManager)
+			info := &doarama.ActivityInfo{TypeID: doarama.FlyParaglide}
+			a1 := client.Activity(mustCreate(t, ac, "track A", info))
+			a2 := client.Activity(mustCreate(t, ac, "track B", info))
+			activities := []*doarama.Activity{a1, a2}
+			for i, tc := range []struct {
+				name    string
+				f       func(*doarama.Visualisation) error
+				wantKey string
+			}{
+				{
+					name: "add",
+					f: func(v *doarama.Visualisation) error {
+						return vm.AddActivities(ctx, v, []*doarama.Activity{client.Activity(99)})
+					},
+					wantKey: "v2",
+				},
+				{
+					name: "remove",
+					f: func(v *doarama.Visualisation) error {
+						return vm.RemoveActivities(ctx, v, []*doarama.Activity{a2})
+					},
+					wantKey: "v4",
+				},
+				{
+					name: "delete",
+					f: func(v *doarama.Visualisation) error {
+						return vm.DeleteVisualisation(ctx, v)
+					},
+					wantKey: "v6",
+				},
+			} {
+				v, err := vc.CreateVisualisation(ctx, activities)
+				if wantKey := fmt.Sprintf("v%d", 2*i+1); err != nil || v.Key != wantKey {
+					t.Fatalf("vc.CreateVisualisation(...) == %v, %v, want key %q, nil", v, err, wantKey)
+				}
+				if err := tc.f(v); err != nil {
+					t.Errorf("%s: got %v, want nil", tc.name, err)
+				}
+				if v, err := vc.CreateVisualisation(ctx, activities); err != nil || v.Key != tc.wantKey {
+					t.Errorf("%s: vc.CreateVisualisation(...) == %v, %v, want key %q, nil", tc.name, v, err, tc.wantKey)
+				}
+				if err := vm.DeleteVisualisation(ctx, client.Visualisation(tc.wantKey)); err != nil {
+					t.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestRollbackKeepsReusedActivities(t *testing.T) {
+	for _, b := range backends {
+		t.Run(b.name, func(t *testing.T) {
+			ctx := context.Background()
+			s := newFakeServer()
+			ts := httptest.NewServer(s)
+			defer ts.Close()
+			client := doarama.NewClient(doarama.APIURL(ts.URL))
+			ac := b.new(t, t.TempDir(), client)
+			defer ac.Close()
+			info := &doarama.ActivityInfo{TypeID: doarama.FlyParaglide}
+			cached := mustCreate(t, ac, "track A", info)
+			s.setFailVisualisations(true)
+			uploads := []doarama.Upload{
+				{Filename: "track.igc", GPSTrack: strings.NewReader("track A"), ActivityInfo: info},
+				{Filename: "track.igc", GPSTrack: strings.NewReader("track B"), ActivityInfo: info},
+			}
+			if v, _, err := doarama.CreateVisualisationFromTracks(ctx, ac.(doarama.ResourceCreator), uploads, 1); err == nil {
+				t.Fatalf("doarama.CreateVisualisationFromTracks(...) == %v, ..., nil, want ..., ..., non-nil", v)
+			}
+			if got := s.getActivities(); got != 1 {
+				t.Errorf("got %d activities, want 1", got)
+			}
+			if got, want := activityIDs(t, ac.(Manager)), []int{cached}; !reflect.DeepEqual(got, want) {
+				t.Errorf("got cached activities %v, want %v", got, want)
+			}
+			if got := mustCreate(t, ac, "track A", info); got != cached {
+				t.Errorf("mustCreate(...) == %d, want %d", got, cached)
+			}
+		})
+	}
+}
+
+func TestSingleFlight(t *testing.T) {
+	for _, b := range backends {
+		t.Run(b.name, func(t *testing.T) {
+			s := newFakeServer()
+			ts := httptest.NewServer(s)
+			defer ts.Close()
+			client := doarama.NewClient(doarama.APIURL(ts.URL))
+			dir := t.TempDir()
+			acs := []ActivityCreator{b.new(t, dir, client)}
+			if b.persistent {
+				acs = append(acs, b.new(t, dir, client))
+			}
+			defer func() {
+				for _, ac := range acs {
+					ac.Close()
+				}
+			}()
+			info := &doarama.ActivityInfo{TypeID: doarama.FlyParaglide}
+			n := 8
+			ids := make([]int, n)
+			var wg sync.WaitGroup
+			for i := 0; i < n; i++ {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					ac := acs[i%len(acs)]
+					a, err := ac.CreateActivityWithInfo(context.Background(), "track.igc", strings.NewReader("track"), info)
+					if err != nil {
+						t.Errorf("ac.CreateActivityWithInfo(...) == %v, %v, want ..., nil", a, err)
+						return
+					}
+					ids[i] = a.ID
+				}(i)
+			}
+			wg.Wait()
+			for i := 1; i < n; i++ {
+				if ids[i] != ids[0] {
+					t.Errorf("got ids %v, want all equal", ids)
+					break
+				}
+			}
+			if got := s.getUploads(); got > len(acs) {
+				t.Errorf("got %d uploads, want at most %d", got, len(acs))
+			}
+			if got := s.getActivities(); got != 1 {
+				t.Errorf("got %d activities on server, want 1", got)
+			}
+		})
+	}
+}
+
+func TestNormalize(t *testing.T) {
+	igc := "" +
+		"AXXX001\n" +
+		"HFDTE050715\n" +
+		"B1115004748247N01306654EA0127200000\n" +
+		"B1115014748248N01306655EA0127300000\n"
+	reexported := "" +
+		"AXXX001\r\n" +
+		"HFDTE050715\r\n" +
+		"HFPLTPILOTINCHARGE:Tom\r\n" +
+		"B1115004748247N01306654EA0127200000\r\n" +
+		"B1115014748248N01306655EA0127300000\r\n"
+	for _, b := range backends {
+		for _, tc := range []struct {
+			normalize   bool
+			wantUploads int
+		}{
+			{normalize: false, wantUploads: 3},
+			{normalize: true, wantUploads: 2},
+		} {
+			t.Run(fmt.Sprintf("%s/normalize=%t", b.name, tc.normalize), func(t *testing.T) {
+				s := newFakeServer()
+				ts := httptest.NewServer(s)
+				defer ts.Close()
+				client := doarama.NewClient(doarama.APIURL(ts.URL))
+				ac := b.new(t, t.TempDir(), client, Normalize(tc.normalize))
+				defer ac.Close()
+				info := &doarama.ActivityInfo{TypeID: doarama.FlyParaglide}
+				id1 := mustCreate(t, ac, igc, info)
+				id2 := mustCreate(t, ac, reexported, info)
+				if tc.normalize && id2 != id1 {
+					t.Errorf("got ids %d and %d, want equal ids", id1, id2)
+				}
+				mustCreate(t, ac, "not a track", info)
+				if got := s.getUploads(); got != tc.wantUploads {
+					t.Errorf("got %d uploads, want %d", got, tc.wantUploads)
+				}
+			})
+		}
+	}
+}
+
+func TestScope(t *testing.T) {
+	for _, b := range backends {
+		t.Run(b.name, func(t *testing.T) {
+			ctx := context.Background()
+			s1, s2 := newFakeServer(), newFakeServer()
+			ts1, ts2 := httptest.NewServer(s1), httptest.NewServer(s2)
+			defer ts1.Close()
+			defer ts2.Close()
+			ac := b.new(t, t.TempDir(), doarama.NewClient(doarama.APIURL(ts1.URL), doarama.Anonymous("tom")))
+			defer ac.Close()
+			st := ac.(*cache).store
+			info := &doarama.ActivityInfo{TypeID: doarama.FlyParaglide}
+			for i, tc := range []struct {
+				client       *doarama.Client
+				wantUploads1 int
+				wantUploads2 int
+			}{
+				{client: doarama.NewClient(doarama.APIURL(ts1.URL), doarama.Anonymous("tom")), wantUploads1: 1},
+				{client: doarama.NewClient(doarama.APIURL(ts1.URL), doarama.Anonymous("tom")), wantUploads1: 1},
+				{client: doarama.NewClient(doarama.APIURL(ts1.URL), doarama.Anonymous("jerry")), wantUploads1: 2},
+				{client: doarama.NewClient(doarama.APIURL(ts1.URL), doarama.APIName("other"), doarama.Anonymous("tom")), wantUploads1: 3},
+				{client: doarama.NewClient(doarama.APIURL(ts2.URL), doarama.Anonymous("tom")), wantUploads1: 3, wantUploads2: 1},
+			} {
+				c := newCache(tc.client, st, nil)
+				a := tc.client.Activity(mustCreate(t, c, "track", info))
+				if s1.getUploads() != tc.wantUploads1 || s2.getUploads() != tc.wantUploads2 {
+					t.Errorf("%d: got %d and %d uploads, want %d and %d", i, s1.getUploads(), s2.getUploads(), tc.wantUploads1, tc.wantUploads2)
+				}
+				v, err := c.CreateVisualisation(ctx, []*doarama.Activity{a})
+				if err != nil {
+					t.Fatalf("%d: c.CreateVisualisation(...) == %v, %v, want ..., nil", i, v, err)
+				}
+			}
+			if got := s1.getVisualisations() + s2.getVisualisations(); got != 4 {
+				t.Errorf("got %d visualisations, want 4", got)
+			}
+		})
+	}
+}
+
+func TestPrivacy(t *testing.T) {
+	igc := "" +
+		"HFDTE050715\r\n" +
+		"B0930004747931N01302904EA0043000430\r\n" +
+		"B1115004748247N01306654EA0127200000\r\n"
+	zones := []doarama.PrivacyZone{{Latitude: 47.79885, Longitude: 13.04840, Radius: 500}}
+	for _, b := range backends {
+		t.Run(b.name, func(t *testing.T) {
+			s := newFakeServer()
+			ts := httptest.NewServer(s)
+			defer ts.Close()
+			ac := b.new(t, t.TempDir(), doarama.NewClient(doarama.APIURL(ts.URL)))
+			defer ac.Close()
+			st := ac.(*cache).store
+			info := &doarama.ActivityInfo{TypeID: doarama.FlyParaglide}
+			for i, tc := range []struct {
+				privacyFilter *doarama.PrivacyFilter
+				wantUploads   int
+			}{
+				{wantUploads: 1},
+				{privacyFilter: &doarama.PrivacyFilter{}, wantUploads: 1},
+				{privacyFilter: &doarama.PrivacyFilter{Zones: zones}, wantUploads: 2},
+				{privacyFilter: &doarama.PrivacyFilter{Zones: zones}, wantUploads: 2},
+				{privacyFilter: &doarama.PrivacyFilter{Zones: zones, Jitter: true}, wantUploads: 3},
+				{privacyFilter: &doarama.PrivacyFilter{Zones: append(zones, doarama.PrivacyZone{Latitude: 46, Longitude: 13, Radius: 500})}, wantUploads: 4},
+				{wantUploads: 4},
+			} {
+				client := doarama.NewClient(doarama.APIURL(ts.URL), doarama.Privacy(tc.privacyFilter))
+				mustCreate(t, newCache(client, st, nil), igc, info)
+				if got := s.getUploads(); got != tc.wantUploads {
+					t.Errorf("%d: got %d uploads, want %d", i, got, tc.wantUploads)
+				}
+			}
+		})
+	}
+}
+
+func TestScopedActivityIDs(t *testing.T) {
+	for _, b := range backends {
+		t.Run(b.name, func(t *testing.T) {
+			ctx := context.Background()
+			s1, s2 := newFakeServer(), newFakeServer()
+			ts1, ts2 := httptest.NewServer(s1), httptest.NewServer(s2)
+			defer ts1.Close()
+			defer ts2.Close()
+			client1 := doarama.NewClient(doarama.APIURL(ts1.URL), doarama.Anonymous("tom"))
+			client2 := doarama.NewClient(doarama.APIURL(ts2.URL), doarama.Anonymous("tom"))
+			ac := b.new(t, t.TempDir(), client1)
+			defer ac.Close()
+			st := ac.(*cache).store
+			c1, c2 := newCache(client1, st, nil), newCache(client2, st, nil)
+			info := &doarama.ActivityInfo{TypeID: doarama.FlyParaglide}
+
+			// Both servers return the same activity ID.
+			id1, id2 := mustCreate(t, c1, "track A", info), mustCreate(t, c2, "track B", info)
+			if id1 != id2 {
+				t.Fatalf("got activity IDs %d and %d, want equal IDs", id1, id2)
+			}
+			if got, want := activityIDs(t, c1), []int{id1, id2}; !reflect.DeepEqual(got, want) {
+				t.Errorf("activityIDs(...) == %v, want %v", got, want)
+			}
+			for i, c := range []*cache{c1, c2} {
+				e, err := c.Entry(ctx, id1)
+				if err != nil || e == nil || e.APIURL != c.client.APIURL() {
+					t.Errorf("%d: c.Entry(ctx, %d) == %#v, %v, want entry from %s, nil", i, id1, e, err, c.client.APIURL())
+				}
+				if _, err := c.CreateVisualisation(ctx, []*doarama.Activity{c.client.Activity(id1)}); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			// Verifying with one client does not check or evict the other
+			// client's activities.
+			if err := client2.Activity(id2).Delete(ctx); err != nil {
+				t.Fatal(err)
+			}
+			if got, err := c1.Verify(ctx); err != nil || len(got) != 0 {
+				t.Errorf("c1.Verify(ctx) == %v, %v, want [], nil", got, err)
+			}
+			if got, err := c2.Verify(ctx); err != nil || !reflect.DeepEqual(got, []int{id2}) {
+				t.Errorf("c2.Verify(ctx) == %v, %v, want %v, nil", got, err, []int{id2})
+			}
+			if e, err := c1.Entry(ctx, id1); err != nil || e == nil {
+				t.Errorf("c1.Entry(ctx, %d) == %v, %v, want non-nil, nil", id1, e, err)
+			}
+			if _, err := c1.CreateVisualisation(ctx, []*doarama.Activity{client1.Activity(id1)}); err != nil || s1.getVisualisations() != 1 {
+				t.Errorf("c1.CreateVisualisation(...) == ..., %v after %d visualisations, want ..., nil after 1 visualisation", err, s1.getVisualisations())
+			}
+
+			// Re-uploading to the second server does not evict the first
+			// server's entry with the same activity ID.
+			if got := mustCreate(t, c2, "track B", info); got == id2 || s2.getUploads() != 2 {
+				t.Errorf("mustCreate(...) == %d after %d uploads, want new ID after 2 uploads", got, s2.getUploads())
+			}
+			if got := mustCreate(t, c1, "track A", info); got != id1 || s1.getUploads() != 1 {
+				t.Errorf("mustCreate(...) == %d after %d uploads, want %d after 1 upload", got, s1.getUploads(), id1)
+			}
+
+			// Deleting an entry only deletes it in its own scope.
+			e, err := c2.Entry(ctx, 2)
+			if err != nil || e == nil {
+				t.Fatalf("c2.Entry(ctx, 2) == %v, %v, want non-nil, nil", e, err)
+			}
+			if err := c1.DeleteActivity(ctx, client1.Activity(2)); err != nil {
+				t.Errorf("c1.DeleteActivity(ctx, 2) == %v, want nil", err)
+			}
+			if e, err := c2.Entry(ctx, 2); err != nil || e == nil {
+				t.Errorf("c2.Entry(ctx, 2) == %v, %v, want non-nil, nil", e, err)
+			}
+			if err := c1.DeleteEntry(ctx, e); err != nil {
+				t.Errorf("c1.DeleteEntry(ctx, %#v) == %v, want nil", e, err)
+			}
+			if e, err := c2.Entry(ctx, 2); err != nil || e != nil {
+				t.Errorf("c2.Entry(ctx, 2) == %v, %v, want nil, nil", e, err)
+			}
+			if e, err := c1.Entry(ctx, id1); err != nil || e == nil {
+				t.Errorf("c1.Entry(ctx, %d) == %v, %v, want non-nil, nil", id1, e, err)
+			}
+		})
+	}
+}
+
+func TestTTL(t *testing.T) {
+	for _, b := range backends {
+		t.Run(b.name, func(t *testing.T) {
+			ctx := context.Background()
+			s := newFakeServer()
+			ts := httptest.NewServer(s)
+			defer ts.Close()
+			client := doarama.NewClient(doarama.APIURL(ts.URL))
+			ac := b.new(t, t.TempDir(), client, TTL(time.Millisecond))
+			defer ac.Close()
+			info := &doarama.ActivityInfo{TypeID: doarama.FlyParaglide}
+			id1 := mustCreate(t, ac, "track", info)
+			e, err := ac.(Manager).Entry(ctx, id1)
+			if err != nil || e == nil || e.Expires.Sub(e.Created) != time.Millisecond {
+				t.Errorf("ac.Entry(ctx, %d) == %#v, %v, want entry expiring after 1ms, nil", id1, e, err)
+			}
+			time.Sleep(2 * time.Millisecond)
+			if id2 := mustCreate(t, ac, "track", info); id2 == id1 || s.getUploads() != 2 {
+				t.Errorf("create after expiry returned %d after %d uploads, want new id after 2 uploads", id2, s.getUploads())
+			}
+			if got, want := activityIDs(t, ac.(Manager)), []int{2}; !reflect.DeepEqual(got, want) {
+				t.Errorf("activityIDs(...) == %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestSQLite3Migrations(t *testing.T) {
+	created := time.Date(2015, 7, 5, 9, 30, 0, 0, time.UTC)
+	for _, tc := range []struct {
+		name        string
+		stmts       []string
+		wantEntries []*Entry
+	}{
+		{
+			name: "baseline",
+			stmts: []string{
+				"" +
+					"CREATE TABLE activities (\n" +
+					"  activity_id INT UNIQUE,\n" +
+					"  gpstrack_sha256 STRING(32) UNIQUE,\n" +
+					"  activityinfo_sha256 STRING(32) UNIQUE\n" +
+					");",
+				"INSERT INTO activities(activity_id, gpstrack_sha256, activityinfo_sha256) VALUES (1, x'01', x'11');",
+				"INSERT INTO activities(activity_id, gpstrack_sha256, activityinfo_sha256) VALUES (2, x'02', x'12');",
+			},
+			wantEntries: []*Entry{
+				{ActivityID: 1, GPSTrackSHA256: SHA256{0x01}, ActivityInfoSHA256: SHA256{0x11}},
+				{ActivityID: 2, GPSTrackSHA256: SHA256{0x02}, ActivityInfoSHA256: SHA256{0x12}},
+			},
+		},
+		{
+			name: "filename_and_created_at",
+			stmts: []string{
+				"" +
+					"CREATE TABLE activities (\n" +
+					"  activity_id INT UNIQUE,\n" +
+					"  gpstrack_sha256 STRING(32) UNIQUE,\n" +
+					"  activityinfo_sha256 STRING(32) UNIQUE,\n" +
+					"  filename STRING,\n" +
+					"  created_at TIMESTAMP\n" +
+					");",
+				"INSERT INTO activities(activity_id, gpstrack_sha256, activityinfo_sha256, filename, created_at) VALUES (1, x'01', x'11', 'a.igc', '2015-07-05 09:30:00+00:00');",
+				"INSERT INTO activities(activity_id, gpstrack_sha256, activityinfo_sha256, filename, created_at) VALUES (2, x'02', x'12', NULL, NULL);",
+			},
+			wantEntries: []*Entry{
+				{ActivityID: 1, GPSTrackSHA256: SHA256{0x01}, ActivityInfoSHA256: SHA256{0x11}, Filename: "a.igc", Created: created},
+				{ActivityID: 2, GPSTrackSHA256: SHA256{0x02}, ActivityInfoSHA256: SHA256{0x12}},
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			filename := filepath.Join(t.TempDir(), "cache.sqlite3")
+			db, err := sql.Open("sqlite3", filename)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, stmt := range tc.stmts {
+				if _, err := db.Exec(stmt); err != nil {
+					t.Fatalf("db.Exec(%q) == ..., %v, want ..., nil", stmt, err)
+				}
+			}
+			if err := db.Close(); err != nil {
+				t.Fatal(err)
+			}
+			// Open the cache twice to check that migrated caches are not
+			// migrated again.
+			for i := 0; i < 2; i++ {
+				ac, err := NewSQLite3(filename, doarama.NewClient())
+				if err != nil {
+					t.Fatalf("%d: NewSQLite3(...) == ..., %v, want ..., nil", i, err)
+				}
+				entries, err := ac.(Manager).Entries(context.Background())
+				if err != nil {
+					t.Fatalf("%d: ac.Entries(...) == ..., %v, want ..., nil", i, err)
+				}
+				for _, e := range entries {
+					e.Created = e.Created.UTC()
+				}
+				if !reflect.DeepEqual(entries, tc.wantEntries) {
+					t.Errorf("%d: ac.Entries(...) == %v, want %v", i, entries, tc.wantEntries)
+				}
+				if err := ac.Close(); err != nil {
+					t.Fatal(err)
+				}
+			}
+		})
+	}
+}
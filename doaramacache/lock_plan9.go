@@ -0,0 +1,18 @@
+//go:build plan9
+// +build plan9
+
+package doaramacache
+
+import "sync"
+
+var lockFileMutex sync.Mutex
+
+// lockFile acquires a lock that is only exclusive within this process. Locks
+// are not shared with other processes on this platform.
+func lockFile(filename string) (func() error, error) {
+	lockFileMutex.Lock()
+	return func() error {
+		lockFileMutex.Unlock()
+		return nil
+	}, nil
+}
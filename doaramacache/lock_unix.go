@@ -0,0 +1,29 @@
+//go:build !plan9 && !windows
+// +build !plan9,!windows
+
+package doaramacache
+
+import (
+	"os"
+	"syscall"
+)
+
+// lockFile acquires an exclusive lock on filename, creating it if needed, and
+// returns a function that releases the lock.
+func lockFile(filename string) (func() error, error) {
+	f, err := os.OpenFile(filename, os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return func() error {
+		if err := syscall.Flock(int(f.Fd()), syscall.LOCK_UN); err != nil {
+			f.Close()
+			return err
+		}
+		return f.Close()
+	}, nil
+}
@@ -0,0 +1,32 @@
+//go:build windows
+// +build windows
+
+package doaramacache
+
+import (
+	"os"
+
+	"golang.org/x/sys/windows"
+)
+
+// lockFile acquires an exclusive lock on filename, creating it if needed, and
+// returns a function that releases the lock.
+func lockFile(filename string) (func() error, error) {
+	f, err := os.OpenFile(filename, os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, err
+	}
+	h := windows.Handle(f.Fd())
+	ol := &windows.Overlapped{}
+	if err := windows.LockFileEx(h, windows.LOCKFILE_EXCLUSIVE_LOCK, 0, 1, 0, ol); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return func() error {
+		if err := windows.UnlockFileEx(h, 0, 1, 0, ol); err != nil {
+			f.Close()
+			return err
+		}
+		return f.Close()
+	}, nil
+}
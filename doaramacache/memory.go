@@ -0,0 +1,155 @@
+package doaramacache
+
+import (
+	"context"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/twpayne/go-doarama"
+)
+
+type memory struct {
+	sync.Mutex
+	entries        map[string]*Entry
+	visualisations map[visualisationKey]string
+}
+
+// NewMemory returns a new ActivityCreator that caches activities from client
+// in memory. The returned ActivityCreator also implements Manager, Verifier,
+// and VisualisationCreator.
+func NewMemory(client *doarama.Client, options ...Option) ActivityCreator {
+	return newCache(client, &memory{
+		entries:        make(map[string]*Entry),
+		visualisations: make(map[visualisationKey]string),
+	}, options)
+}
+
+// Add implements store.
+func (m *memory) Add(ctx context.Context, e *Entry) (*Entry, error) {
+	m.Lock()
+	defer m.Unlock()
+	k := e.key().String()
+	if existing, ok := m.entries[k]; ok {
+		c := *existing
+		return &c, nil
+	}
+	m.delete(e.scope(), e.ActivityID)
+	c := *e
+	m.entries[k] = &c
+	return e, nil
+}
+
+// Close implements store.
+func (m *memory) Close() error {
+	return nil
+}
+
+// delete deletes the entry with the specified scope and activity ID. m must be
+// locked.
+func (m *memory) delete(s scope, activityID int) {
+	for k, e := range m.entries {
+		if e.scope() == s && e.ActivityID == activityID {
+			delete(m.entries, k)
+		}
+	}
+}
+
+// Delete implements store.
+func (m *memory) Delete(ctx context.Context, s scope, activityID int) error {
+	m.Lock()
+	defer m.Unlock()
+	m.delete(s, activityID)
+	return nil
+}
+
+// DeleteVisualisation implements store.
+func (m *memory) DeleteVisualisation(ctx context.Context, s scope, key string) error {
+	m.Lock()
+	defer m.Unlock()
+	for k, v := range m.visualisations {
+		if k.scope == s && v == key {
+			delete(m.visualisations, k)
+		}
+	}
+	return nil
+}
+
+// DeleteVisualisations implements store.
+func (m *memory) DeleteVisualisations(ctx context.Context, s scope, activityID int) error {
+	m.Lock()
+	defer m.Unlock()
+	id := "," + strconv.Itoa(activityID) + ","
+	for k := range m.visualisations {
+		if k.scope == s && strings.Contains(k.ActivityIDs, id) {
+			delete(m.visualisations, k)
+		}
+	}
+	return nil
+}
+
+// Entries implements store.
+func (m *memory) Entries(ctx context.Context) ([]*Entry, error) {
+	m.Lock()
+	defer m.Unlock()
+	entries := make([]*Entry, 0, len(m.entries))
+	for _, e := range m.entries {
+		c := *e
+		entries = append(entries, &c)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].ActivityID < entries[j].ActivityID
+	})
+	return entries, nil
+}
+
+// Entry implements store.
+func (m *memory) Entry(ctx context.Context, s scope, activityID int) (*Entry, error) {
+	m.Lock()
+	defer m.Unlock()
+	for _, e := range m.entries {
+		if e.scope() == s && e.ActivityID == activityID {
+			c := *e
+			return &c, nil
+		}
+	}
+	return nil, nil
+}
+
+// Get implements store.
+func (m *memory) Get(ctx context.Context, k entryKey) (*Entry, error) {
+	m.Lock()
+	defer m.Unlock()
+	e, ok := m.entries[k.String()]
+	if !ok {
+		return nil, nil
+	}
+	c := *e
+	return &c, nil
+}
+
+// GetVisualisation implements store.
+func (m *memory) GetVisualisation(ctx context.Context, k visualisationKey) (string, error) {
+	m.Lock()
+	defer m.Unlock()
+	return m.visualisations[k], nil
+}
+
+// Put implements store.
+func (m *memory) Put(ctx context.Context, e *Entry) error {
+	m.Lock()
+	defer m.Unlock()
+	m.delete(e.scope(), e.ActivityID)
+	c := *e
+	m.entries[e.key().String()] = &c
+	return nil
+}
+
+// PutVisualisation implements store.
+func (m *memory) PutVisualisation(ctx context.Context, k visualisationKey, key string) error {
+	m.Lock()
+	defer m.Unlock()
+	m.visualisations[k] = key
+	return nil
+}
@@ -1,97 +1,428 @@
 package doaramacache
 
 import (
-	"bytes"
 	"context"
-	"crypto/sha256"
 	"database/sql"
-	"io"
-	"io/ioutil"
+	"fmt"
+	"strconv"
+	"time"
 
-	"github.com/cnf/structhash"
 	"github.com/twpayne/go-doarama"
 )
 
 type sqlite struct {
-	client     *doarama.Client
 	db         *sql.DB
+	deleteStmt *sql.Stmt
 	insertStmt *sql.Stmt
-	queryStmt  *sql.Stmt
+}
+
+// migrations upgrade the schema. migrations[i] upgrades the schema from
+// version i to version i+1.
+var migrations = []func(*sql.Tx) error{
+	migrateToComposite,
+	migrateAddVisualisations,
+	migrateToScoped,
+	migrateToScopedActivityIDs,
 }
 
 // NewSQLite3 returns a new ActivityCreator that caches activities from client
-// in dataSourceName.
-func NewSQLite3(dataSourceName string, client *doarama.Client) (ActivityCreator, error) {
+// in dataSourceName. The returned ActivityCreator also implements Manager,
+// Verifier, and VisualisationCreator.
+func NewSQLite3(dataSourceName string, client *doarama.Client, options ...Option) (ActivityCreator, error) {
 	db, err := sql.Open("sqlite3", dataSourceName)
 	if err != nil {
 		return nil, err
 	}
-	if _, err := db.Exec("" +
-		"CREATE TABLE IF NOT EXISTS activities (\n" +
-		"  activity_id INT UNIQUE,\n" +
-		"  gpstrack_sha256 STRING(32) UNIQUE,\n" +
-		"  activityinfo_sha256 STRING(32) UNIQUE\n" +
-		");"); err != nil {
+	if err := migrate(db); err != nil {
+		db.Close()
 		return nil, err
 	}
-	insertStmt, err := db.Prepare("" +
-		"INSERT INTO activities(activity_id, gpstrack_sha256, activityinfo_sha256)\n" +
-		"VALUES (?, ?, ?);")
+	deleteStmt, err := db.Prepare("" +
+		"DELETE FROM activities\n" +
+		"WHERE " + scopeWhere + " AND activity_id = ?;")
 	if err != nil {
+		db.Close()
 		return nil, err
 	}
-	queryStmt, err := db.Prepare("" +
-		"SELECT activity_id\n" +
-		"FROM activities\n" +
-		"WHERE gpstrack_sha256 = ? AND activityinfo_sha256 = ?;")
+	insertStmt, err := db.Prepare("" +
+		"INSERT OR REPLACE INTO activities(gpstrack_sha256, activityinfo_sha256, activity_id, filename, size, created_at, api_url, api_name, user, expires_at)\n" +
+		"VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?);")
 	if err != nil {
+		deleteStmt.Close()
+		db.Close()
 		return nil, err
 	}
-	return &sqlite{
-		client:     client,
+	return newCache(client, &sqlite{
 		db:         db,
+		deleteStmt: deleteStmt,
 		insertStmt: insertStmt,
-		queryStmt:  queryStmt,
-	}, nil
+	}, options), nil
 }
 
-// Close releases any resources.
-func (s *sqlite) Close() error {
-	if s != nil {
-		if err := s.insertStmt.Close(); err != nil {
+// migrate upgrades the schema of db to the latest version.
+func migrate(db *sql.DB) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec("" +
+		"CREATE TABLE IF NOT EXISTS schema_version (\n" +
+		"  version INT NOT NULL\n" +
+		");"); err != nil {
+		return err
+	}
+	var version sql.NullInt64
+	if err := tx.QueryRow("SELECT MAX(version) FROM schema_version;").Scan(&version); err != nil {
+		return err
+	}
+	if int(version.Int64) > len(migrations) {
+		return fmt.Errorf("unsupported schema version %d", version.Int64)
+	}
+	for i := int(version.Int64); i < len(migrations); i++ {
+		if err := migrations[i](tx); err != nil {
+			return err
+		}
+		if _, err := tx.Exec("INSERT INTO schema_version(version) VALUES (?);", i+1); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// hasColumn returns whether table has column.
+func hasColumn(tx *sql.Tx, table, column string) (bool, error) {
+	var n int
+	err := tx.QueryRow(""+
+		"SELECT COUNT(*)\n"+
+		"FROM pragma_table_info(?)\n"+
+		"WHERE name = ?;", table, column).Scan(&n)
+	return n != 0, err
+}
+
+// migrateToComposite creates the activities table keyed on both hashes,
+// copying any activities from the original layout, which only stored the
+// activity ID and the hashes and optionally the filename and creation time.
+func migrateToComposite(tx *sql.Tx) error {
+	if _, err := tx.Exec("" +
+		"CREATE TABLE activities_v1 (\n" +
+		"  gpstrack_sha256 BLOB NOT NULL,\n" +
+		"  activityinfo_sha256 BLOB NOT NULL,\n" +
+		"  activity_id INT NOT NULL UNIQUE,\n" +
+		"  filename STRING,\n" +
+		"  size INT,\n" +
+		"  created_at TIMESTAMP,\n" +
+		"  api_url STRING,\n" +
+		"  api_name STRING,\n" +
+		"  user STRING,\n" +
+		"  PRIMARY KEY (gpstrack_sha256, activityinfo_sha256)\n" +
+		");"); err != nil {
+		return err
+	}
+	legacy, err := hasColumn(tx, "activities", "activity_id")
+	if err != nil {
+		return err
+	}
+	if legacy {
+		columns := "gpstrack_sha256, activityinfo_sha256, activity_id"
+		hasFilename, err := hasColumn(tx, "activities", "filename")
+		if err != nil {
+			return err
+		}
+		if hasFilename {
+			columns += ", filename, created_at"
+		}
+		if _, err := tx.Exec("" +
+			"INSERT OR IGNORE INTO activities_v1(" + columns + ")\n" +
+			"SELECT " + columns + "\n" +
+			"FROM activities;"); err != nil {
+			return err
+		}
+		if _, err := tx.Exec("DROP TABLE activities;"); err != nil {
+			return err
+		}
+	}
+	_, err = tx.Exec("ALTER TABLE activities_v1 RENAME TO activities;")
+	return err
+}
+
+// migrateAddVisualisations creates the visualisations table.
+func migrateAddVisualisations(tx *sql.Tx) error {
+	_, err := tx.Exec("" +
+		"CREATE TABLE visualisations (\n" +
+		"  activity_ids STRING NOT NULL PRIMARY KEY,\n" +
+		"  visualisation_key STRING NOT NULL,\n" +
+		"  created_at TIMESTAMP\n" +
+		");")
+	return err
+}
+
+// migrateToScoped adds the API URL, API name, and user to the keys of the
+// activities and visualisations tables, and adds expiry times to activities.
+// Existing rows without an API URL, API name, or user are kept with empty
+// values so that they are listed, but are never re-used.
+func migrateToScoped(tx *sql.Tx) error {
+	for _, stmt := range []string{
+		"" +
+			"CREATE TABLE activities_v3 (\n" +
+			"  api_url STRING NOT NULL DEFAULT '',\n" +
+			"  api_name STRING NOT NULL DEFAULT '',\n" +
+			"  user STRING NOT NULL DEFAULT '',\n" +
+			"  gpstrack_sha256 BLOB NOT NULL,\n" +
+			"  activityinfo_sha256 BLOB NOT NULL,\n" +
+			"  activity_id INT NOT NULL UNIQUE,\n" +
+			"  filename STRING,\n" +
+			"  size INT,\n" +
+			"  created_at TIMESTAMP,\n" +
+			"  expires_at TIMESTAMP,\n" +
+			"  PRIMARY KEY (api_url, api_name, user, gpstrack_sha256, activityinfo_sha256)\n" +
+			");",
+		"" +
+			"INSERT INTO activities_v3(api_url, api_name, user, gpstrack_sha256, activityinfo_sha256, activity_id, filename, size, created_at)\n" +
+			"SELECT COALESCE(api_url, ''), COALESCE(api_name, ''), COALESCE(user, ''), gpstrack_sha256, activityinfo_sha256, activity_id, filename, size, created_at\n" +
+			"FROM activities;",
+		"DROP TABLE activities;",
+		"ALTER TABLE activities_v3 RENAME TO activities;",
+		"" +
+			"CREATE TABLE visualisations_v3 (\n" +
+			"  api_url STRING NOT NULL DEFAULT '',\n" +
+			"  api_name STRING NOT NULL DEFAULT '',\n" +
+			"  user STRING NOT NULL DEFAULT '',\n" +
+			"  activity_ids STRING NOT NULL,\n" +
+			"  visualisation_key STRING NOT NULL,\n" +
+			"  created_at TIMESTAMP,\n" +
+			"  PRIMARY KEY (api_url, api_name, user, activity_ids)\n" +
+			");",
+		"" +
+			"INSERT INTO visualisations_v3(activity_ids, visualisation_key, created_at)\n" +
+			"SELECT activity_ids, visualisation_key, created_at\n" +
+			"FROM visualisations;",
+		"DROP TABLE visualisations;",
+		"ALTER TABLE visualisations_v3 RENAME TO visualisations;",
+	} {
+		if _, err := tx.Exec(stmt); err != nil {
 			return err
 		}
-		if err := s.queryStmt.Close(); err != nil {
+	}
+	return nil
+}
+
+// migrateToScopedActivityIDs makes activity IDs unique within each API URL,
+// API name, and user rather than globally, as activity IDs from different API
+// endpoints are unrelated.
+func migrateToScopedActivityIDs(tx *sql.Tx) error {
+	for _, stmt := range []string{
+		"" +
+			"CREATE TABLE activities_v4 (\n" +
+			"  api_url STRING NOT NULL DEFAULT '',\n" +
+			"  api_name STRING NOT NULL DEFAULT '',\n" +
+			"  user STRING NOT NULL DEFAULT '',\n" +
+			"  gpstrack_sha256 BLOB NOT NULL,\n" +
+			"  activityinfo_sha256 BLOB NOT NULL,\n" +
+			"  activity_id INT NOT NULL,\n" +
+			"  filename STRING,\n" +
+			"  size INT,\n" +
+			"  created_at TIMESTAMP,\n" +
+			"  expires_at TIMESTAMP,\n" +
+			"  PRIMARY KEY (api_url, api_name, user, gpstrack_sha256, activityinfo_sha256),\n" +
+			"  UNIQUE (api_url, api_name, user, activity_id)\n" +
+			");",
+		"" +
+			"INSERT INTO activities_v4(api_url, api_name, user, gpstrack_sha256, activityinfo_sha256, activity_id, filename, size, created_at, expires_at)\n" +
+			"SELECT api_url, api_name, user, gpstrack_sha256, activityinfo_sha256, activity_id, filename, size, created_at, expires_at\n" +
+			"FROM activities;",
+		"DROP TABLE activities;",
+		"ALTER TABLE activities_v4 RENAME TO activities;",
+	} {
+		if _, err := tx.Exec(stmt); err != nil {
 			return err
 		}
 	}
 	return nil
 }
 
-// CreateActivityWithInfo creates an activity, re-using a previous activity if
-// available.
-func (s *sqlite) CreateActivityWithInfo(ctx context.Context, filename string, gpsTrack io.Reader, activityInfo *doarama.ActivityInfo) (*doarama.Activity, error) {
-	content, err := ioutil.ReadAll(gpsTrack)
+// scopeWhere is the condition matching the arguments returned by scopeArgs.
+const scopeWhere = "api_url = ? AND api_name = ? AND user = ?"
+
+// scopeArgs returns the arguments to match s with scopeWhere, followed by
+// args.
+func scopeArgs(s scope, args ...interface{}) []interface{} {
+	return append([]interface{}{s.APIURL, s.APIName, s.User}, args...)
+}
+
+// nullTime returns t as a value for a nullable TIMESTAMP column.
+func nullTime(t time.Time) interface{} {
+	if t.IsZero() {
+		return nil
+	}
+	return t.UTC()
+}
+
+// entryArgs returns the arguments to insert e.
+func entryArgs(e *Entry) []interface{} {
+	return []interface{}{[]byte(e.GPSTrackSHA256), []byte(e.ActivityInfoSHA256), e.ActivityID, e.Filename, e.Size, nullTime(e.Created), e.APIURL, e.APIName, e.User, nullTime(e.Expires)}
+}
+
+// Add implements store. The insert is the first statement in the transaction
+// so that the write lock is acquired, and concurrent writers wait, before
+// checking which entry won.
+func (s *sqlite) Add(ctx context.Context, e *Entry) (*Entry, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
 	if err != nil {
 		return nil, err
 	}
-	gpsTrackSha256 := sha256.Sum256(content)
-	activityInfoSha256 := sha256.Sum256(structhash.Dump(activityInfo, 0))
+	defer tx.Rollback()
+	args := entryArgs(e)
+	if _, err := tx.ExecContext(ctx, ""+
+		"INSERT OR IGNORE INTO activities(gpstrack_sha256, activityinfo_sha256, activity_id, filename, size, created_at, api_url, api_name, user, expires_at)\n"+
+		"VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?);", args...); err != nil {
+		return nil, err
+	}
 	var activityID int
-	switch err := s.queryStmt.QueryRow(gpsTrackSha256[:], activityInfoSha256[:]).Scan(&activityID); err {
-	case nil:
-		return &doarama.Activity{
-			Client: s.client,
-			ID:     activityID,
-		}, nil
-	case sql.ErrNoRows:
-		activity, err := s.client.CreateActivityWithInfo(ctx, filename, bytes.NewBuffer(content), activityInfo)
-		if err != nil {
-			return activity, err
+	switch err := tx.QueryRowContext(ctx, ""+
+		"SELECT activity_id\n"+
+		"FROM activities\n"+
+		"WHERE "+entryKeyWhere+";", entryKeyArgs(e.key())...).Scan(&activityID); {
+	case err == sql.ErrNoRows:
+		// The insert was ignored because of a stale entry with the same
+		// scope and activity ID, so replace it.
+		if _, err := tx.StmtContext(ctx, s.insertStmt).ExecContext(ctx, args...); err != nil {
+			return nil, err
+		}
+		activityID = e.ActivityID
+	case err != nil:
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	if activityID == e.ActivityID {
+		return e, nil
+	}
+	return s.Entry(ctx, e.scope(), activityID)
+}
+
+// Close releases any resources.
+func (s *sqlite) Close() error {
+	if err := s.deleteStmt.Close(); err != nil {
+		return err
+	}
+	if err := s.insertStmt.Close(); err != nil {
+		return err
+	}
+	return s.db.Close()
+}
+
+// Delete implements store.
+func (s *sqlite) Delete(ctx context.Context, sc scope, activityID int) error {
+	_, err := s.deleteStmt.ExecContext(ctx, scopeArgs(sc, activityID)...)
+	return err
+}
+
+// DeleteVisualisation implements store.
+func (s *sqlite) DeleteVisualisation(ctx context.Context, sc scope, key string) error {
+	_, err := s.db.ExecContext(ctx, ""+
+		"DELETE FROM visualisations\n"+
+		"WHERE "+scopeWhere+" AND visualisation_key = ?;", scopeArgs(sc, key)...)
+	return err
+}
+
+// DeleteVisualisations implements store.
+func (s *sqlite) DeleteVisualisations(ctx context.Context, sc scope, activityID int) error {
+	_, err := s.db.ExecContext(ctx, ""+
+		"DELETE FROM visualisations\n"+
+		"WHERE "+scopeWhere+" AND instr(activity_ids, ?) > 0;", scopeArgs(sc, ","+strconv.Itoa(activityID)+",")...)
+	return err
+}
+
+// queryEntries returns the entries matching where.
+func (s *sqlite) queryEntries(ctx context.Context, where string, args ...interface{}) ([]*Entry, error) {
+	rows, err := s.db.QueryContext(ctx, ""+
+		"SELECT activity_id, gpstrack_sha256, activityinfo_sha256, filename, size, created_at, api_url, api_name, user, expires_at\n"+
+		"FROM activities\n"+
+		where+"\n"+
+		"ORDER BY activity_id;", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var entries []*Entry
+	for rows.Next() {
+		var filename, apiURL, apiName, user sql.NullString
+		var size sql.NullInt64
+		var created, expires sql.NullTime
+		e := &Entry{}
+		if err := rows.Scan(&e.ActivityID, &e.GPSTrackSHA256, &e.ActivityInfoSHA256, &filename, &size, &created, &apiURL, &apiName, &user, &expires); err != nil {
+			return nil, err
 		}
-		_, err = s.insertStmt.Exec(activity.ID, gpsTrackSha256[:], activityInfoSha256[:])
-		return activity, err
-	default:
+		e.Filename = filename.String
+		e.Size = size.Int64
+		e.Created = created.Time
+		e.APIURL = apiURL.String
+		e.APIName = apiName.String
+		e.User = user.String
+		e.Expires = expires.Time
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+// queryEntry returns the first entry matching where, or nil.
+func (s *sqlite) queryEntry(ctx context.Context, where string, args ...interface{}) (*Entry, error) {
+	entries, err := s.queryEntries(ctx, where, args...)
+	if err != nil || len(entries) == 0 {
 		return nil, err
 	}
+	return entries[0], nil
+}
+
+// Entries implements store.
+func (s *sqlite) Entries(ctx context.Context) ([]*Entry, error) {
+	return s.queryEntries(ctx, "")
+}
+
+// Entry implements store.
+func (s *sqlite) Entry(ctx context.Context, sc scope, activityID int) (*Entry, error) {
+	return s.queryEntry(ctx, "WHERE "+scopeWhere+" AND activity_id = ?", scopeArgs(sc, activityID)...)
+}
+
+// entryKeyWhere is the condition matching the arguments returned by
+// entryKeyArgs.
+const entryKeyWhere = scopeWhere + " AND gpstrack_sha256 = ? AND activityinfo_sha256 = ?"
+
+// entryKeyArgs returns the arguments to match k with entryKeyWhere.
+func entryKeyArgs(k entryKey) []interface{} {
+	return scopeArgs(k.scope, []byte(k.GPSTrackSHA256), []byte(k.ActivityInfoSHA256))
+}
+
+// Get implements store.
+func (s *sqlite) Get(ctx context.Context, k entryKey) (*Entry, error) {
+	return s.queryEntry(ctx, "WHERE "+entryKeyWhere, entryKeyArgs(k)...)
+}
+
+// GetVisualisation implements store.
+func (s *sqlite) GetVisualisation(ctx context.Context, k visualisationKey) (string, error) {
+	var key string
+	err := s.db.QueryRowContext(ctx, ""+
+		"SELECT visualisation_key\n"+
+		"FROM visualisations\n"+
+		"WHERE "+scopeWhere+" AND activity_ids = ?;", scopeArgs(k.scope, k.ActivityIDs)...).Scan(&key)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return key, err
+}
+
+// Put implements store.
+func (s *sqlite) Put(ctx context.Context, e *Entry) error {
+	_, err := s.insertStmt.ExecContext(ctx, entryArgs(e)...)
+	return err
+}
+
+// PutVisualisation implements store.
+func (s *sqlite) PutVisualisation(ctx context.Context, k visualisationKey, key string) error {
+	_, err := s.db.ExecContext(ctx, ""+
+		"INSERT OR REPLACE INTO visualisations(api_url, api_name, user, activity_ids, visualisation_key, created_at)\n"+
+		"VALUES (?, ?, ?, ?, ?, ?);", k.APIURL, k.APIName, k.User, k.ActivityIDs, key, time.Now().UTC())
+	return err
 }
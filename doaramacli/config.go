@@ -0,0 +1,285 @@
+package doaramacli
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/urfave/cli"
+)
+
+// DefaultProfile is the profile used when none is specified.
+const DefaultProfile = "default"
+
+// profileMetadataKey is the key of the current profile in the app's metadata.
+const profileMetadataKey = "doaramacli.profile"
+
+// ConfigKeys are the global flags that can be set in a profile. Hyphens in
+// flag names are replaced by underscores.
+var ConfigKeys = []string{
+	"apikey",
+	"apikey_command",
+	"apikey_file",
+	"apiname",
+	"apiurl",
+	"cache",
+	"cache_ttl",
+	"no_cache",
+	"normalize_cache",
+	"output",
+	"privacyjitter",
+	"privacyzones",
+	"userid",
+	"userkey",
+	"userkey_command",
+	"userkey_file",
+	"verify_cache",
+}
+
+// configBoolKeys and configDurationKeys are the keys in ConfigKeys whose
+// values are booleans and durations. All other values are strings.
+var (
+	configBoolKeys = map[string]bool{
+		"no_cache":        true,
+		"normalize_cache": true,
+		"privacyjitter":   true,
+		"verify_cache":    true,
+	}
+	configDurationKeys = map[string]bool{
+		"cache_ttl": true,
+	}
+)
+
+// A Profile is a named set of global flag values.
+type Profile map[string]string
+
+// UnmarshalTOML implements toml.Unmarshaler. Boolean and integer values are
+// converted to strings so that, for example, privacyjitter = true is
+// accepted as well as privacyjitter = "true".
+func (p *Profile) UnmarshalTOML(data interface{}) error {
+	m, ok := data.(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("%v: not a table", data)
+	}
+	*p = make(Profile, len(m))
+	for key, value := range m {
+		switch value := value.(type) {
+		case string:
+			(*p)[key] = value
+		case bool:
+			(*p)[key] = strconv.FormatBool(value)
+		case int64:
+			(*p)[key] = strconv.FormatInt(value, 10)
+		default:
+			return fmt.Errorf("%s: unsupported value %v", key, value)
+		}
+	}
+	return nil
+}
+
+// A Config is a configuration file.
+type Config struct {
+	Profiles map[string]Profile `toml:"profiles"`
+}
+
+// defaultConfig returns the default configuration file, or the empty string
+// if there is no user configuration directory.
+func defaultConfig() string {
+	userConfigDir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(userConfigDir, "doarama", "config.toml")
+}
+
+// IsConfigKey returns whether key can be set in a profile.
+func IsConfigKey(key string) bool {
+	for _, k := range ConfigKeys {
+		if k == key {
+			return true
+		}
+	}
+	return false
+}
+
+// CheckConfigValue returns an error if value is not a valid value for key.
+func CheckConfigValue(key, value string) error {
+	switch {
+	case !IsConfigKey(key):
+		return fmt.Errorf("%s: unknown key", key)
+	case configBoolKeys[key]:
+		if _, err := strconv.ParseBool(value); err != nil {
+			return fmt.Errorf("%s: %q is not a boolean", key, value)
+		}
+	case configDurationKeys[key]:
+		if _, err := time.ParseDuration(value); err != nil {
+			return fmt.Errorf("%s: %q is not a duration", key, value)
+		}
+	}
+	return nil
+}
+
+// ReadConfig reads the configuration file filename. A missing file is an
+// empty configuration.
+func ReadConfig(filename string) (*Config, error) {
+	config := &Config{}
+	if filename == "" {
+		return config, nil
+	}
+	if _, err := toml.DecodeFile(filename, config); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	for name, profile := range config.Profiles {
+		for key, value := range profile {
+			if err := CheckConfigValue(key, value); err != nil {
+				return nil, fmt.Errorf("%s: profile %s: %v", filename, name, err)
+			}
+		}
+	}
+	return config, nil
+}
+
+// Write writes config to filename, which is only readable by the user as
+// profiles may contain secrets.
+func (config *Config) Write(filename string) error {
+	if filename == "" {
+		return errors.New("no configuration file")
+	}
+	var b bytes.Buffer
+	if err := toml.NewEncoder(&b).Encode(config); err != nil {
+		return err
+	}
+	dir := filepath.Dir(filename)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(dir, ".config-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(b.Bytes()); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), filename)
+}
+
+// LoadProfile loads the profile selected by the --profile flag from the
+// configuration file so that its values are used as defaults for global
+// flags. It is intended to be used as the app's Before function. It is an
+// error to select a profile other than DefaultProfile that does not exist.
+func LoadProfile(c *cli.Context) error {
+	config, err := ReadConfig(c.GlobalString("config"))
+	if err != nil {
+		return err
+	}
+	name := c.GlobalString("profile")
+	profile, ok := config.Profiles[name]
+	if !ok && name != DefaultProfile && c.Args().First() != "config" {
+		return fmt.Errorf("%s: profile not found", name)
+	}
+	c.App.Metadata[profileMetadataKey] = profile
+	return nil
+}
+
+// globalString returns the value of the global flag name. Values set on the
+// command line take precedence, followed by environment variables, the
+// current profile, and finally the flag's default value.
+func globalString(c *cli.Context, name string) string {
+	if value, ok := profileValue(c, name); ok {
+		return value
+	}
+	return c.GlobalString(name)
+}
+
+// globalBool returns the value of the global boolean flag name, with the same
+// precedence as globalString.
+func globalBool(c *cli.Context, name string) bool {
+	if value, ok := profileValue(c, name); ok {
+		b, _ := strconv.ParseBool(value) // Checked by ReadConfig.
+		return b
+	}
+	return c.GlobalBool(name)
+}
+
+// globalDuration returns the value of the global duration flag name, with the
+// same precedence as globalString.
+func globalDuration(c *cli.Context, name string) time.Duration {
+	if value, ok := profileValue(c, name); ok {
+		d, _ := time.ParseDuration(value) // Checked by ReadConfig.
+		return d
+	}
+	return c.GlobalDuration(name)
+}
+
+// An Origin is where the value of a setting comes from. Origins are ordered
+// by precedence.
+type Origin int
+
+// Origins.
+const (
+	OriginNone Origin = iota
+	OriginCommandLine
+	OriginEnv
+	OriginProfile
+	OriginDefault
+)
+
+// flagOrigin returns where the value of the global flag name comes from. A
+// value given both on the command line and in the environment is treated as
+// coming from the environment.
+func flagOrigin(c *cli.Context, name string) Origin {
+	if _, ok := profileValue(c, name); ok {
+		return OriginProfile
+	}
+	if !c.GlobalIsSet(name) {
+		return OriginNone
+	}
+	if value, ok := envValue(name); ok && value == c.GlobalString(name) {
+		return OriginEnv
+	}
+	return OriginCommandLine
+}
+
+// envValue returns the value of the environment variable of the global flag
+// name, if it is set.
+func envValue(name string) (string, bool) {
+	for _, flag := range Flags {
+		f, ok := flag.(cli.StringFlag)
+		if !ok || f.Name != name {
+			continue
+		}
+		for _, envVar := range strings.Split(f.EnvVar, ",") {
+			if value, ok := os.LookupEnv(strings.TrimSpace(envVar)); ok {
+				return value, true
+			}
+		}
+	}
+	return "", false
+}
+
+// profileValue returns the value of the global flag name in the current
+// profile, if it is set there and not on the command line or in the
+// environment.
+func profileValue(c *cli.Context, name string) (string, bool) {
+	if c.GlobalIsSet(name) || c.App == nil {
+		return "", false
+	}
+	profile, ok := c.App.Metadata[profileMetadataKey].(Profile)
+	if !ok {
+		return "", false
+	}
+	value, ok := profile[strings.Replace(name, "-", "_", -1)]
+	return value, ok
+}
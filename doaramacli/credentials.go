@@ -0,0 +1,166 @@
+package doaramacli
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+
+	"github.com/urfave/cli"
+)
+
+// A CredentialSource is a source of credentials, such as API keys.
+type CredentialSource interface {
+	// Origin returns where the setting that the source reads the credential
+	// name with comes from, or OriginNone if it is not set.
+	Origin(c *cli.Context, name string) Origin
+	// Credential returns the credential name, for example "apikey", or the
+	// empty string if the source does not have it.
+	Credential(c *cli.Context, name string) (string, error)
+}
+
+// A settingCredentialSource reads credentials with the global flag
+// NAME+suffix.
+type settingCredentialSource struct {
+	suffix string
+	read   func(name, value string) (string, error)
+}
+
+// Origin implements CredentialSource.
+func (s settingCredentialSource) Origin(c *cli.Context, name string) Origin {
+	return flagOrigin(c, name+s.suffix)
+}
+
+// Credential implements CredentialSource.
+func (s settingCredentialSource) Credential(c *cli.Context, name string) (string, error) {
+	value := globalString(c, name+s.suffix)
+	if value == "" {
+		return "", nil
+	}
+	return s.read(name, value)
+}
+
+// A secretServiceCredentialSource looks up credentials in the
+// freedesktop.org Secret Service.
+type secretServiceCredentialSource struct{}
+
+// Origin implements CredentialSource. The Secret Service has no setting, so
+// it is always OriginDefault.
+func (secretServiceCredentialSource) Origin(c *cli.Context, name string) Origin {
+	return OriginDefault
+}
+
+// Credential implements CredentialSource.
+func (secretServiceCredentialSource) Credential(c *cli.Context, name string) (string, error) {
+	return secretLookup(map[string]string{
+		"application": "doarama",
+		"profile":     c.GlobalString("profile"),
+		"key":         name,
+	})
+}
+
+// Credential sources.
+var (
+	// FlagCredentialSource reads the credential from the NAME flag, its
+	// environment variable, or the current profile.
+	FlagCredentialSource CredentialSource = settingCredentialSource{read: flagCredential}
+	// FileCredentialSource reads the credential from the file named by the
+	// NAME-file flag, which must not be accessible by the group or others.
+	FileCredentialSource CredentialSource = settingCredentialSource{suffix: "-file", read: fileCredential}
+	// CommandCredentialSource reads the credential from the standard output
+	// of the shell command in the NAME-command flag.
+	CommandCredentialSource CredentialSource = settingCredentialSource{suffix: "-command", read: commandCredential}
+	// SecretServiceCredentialSource looks up the credential in the
+	// freedesktop.org Secret Service, if available.
+	SecretServiceCredentialSource CredentialSource = secretServiceCredentialSource{}
+)
+
+// CredentialSources are the sources of credentials. Credential consults them
+// by the Origin of their settings, and in this order for settings with the
+// same Origin.
+var CredentialSources = []CredentialSource{
+	FlagCredentialSource,
+	FileCredentialSource,
+	CommandCredentialSource,
+	SecretServiceCredentialSource,
+}
+
+// secretLookup looks up secrets in the Secret Service. Tests replace it.
+var secretLookup = lookupSecret
+
+// Credential returns the credential name from CredentialSources, or the empty
+// string if none have it. Sources set on the command line are consulted
+// first, then sources set in the environment, then sources set in the
+// profile, and finally the Secret Service. Once a source has the credential,
+// no more sources are consulted.
+func Credential(c *cli.Context, name string) (string, error) {
+	return credential(c, name, OriginDefault)
+}
+
+// credential returns the credential name, as Credential, consulting only
+// sources whose Origin is no later than last.
+func credential(c *cli.Context, name string, last Origin) (string, error) {
+	for origin := OriginCommandLine; origin <= last; origin++ {
+		for _, source := range CredentialSources {
+			if source.Origin(c, name) != origin {
+				continue
+			}
+			value, err := source.Credential(c, name)
+			if err != nil {
+				return "", err
+			}
+			if value != "" {
+				return value, nil
+			}
+		}
+	}
+	return "", nil
+}
+
+func flagCredential(name, value string) (string, error) {
+	return value, nil
+}
+
+func fileCredential(name, filename string) (string, error) {
+	fi, err := os.Stat(filename)
+	if err != nil {
+		return "", err
+	}
+	if runtime.GOOS != "windows" && fi.Mode().Perm()&0077 != 0 {
+		return "", fmt.Errorf("%s: permissions %04o are too open, run chmod 600 %s", filename, fi.Mode().Perm(), filename)
+	}
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return "", err
+	}
+	value := strings.TrimSpace(string(data))
+	if value == "" {
+		return "", fmt.Errorf("%s: empty %s", filename, name)
+	}
+	return value, nil
+}
+
+func commandCredential(name, command string) (string, error) {
+	var cmd *exec.Cmd
+	if runtime.GOOS == "windows" {
+		cmd = exec.Command("cmd", "/C", command)
+	} else {
+		cmd = exec.Command("/bin/sh", "-c", command)
+	}
+	var stdout bytes.Buffer
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = &stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("%s-command: %v", name, err)
+	}
+	value := strings.TrimSpace(stdout.String())
+	if value == "" {
+		return "", errors.New(name + "-command: no output")
+	}
+	return value, nil
+}
@@ -4,8 +4,15 @@ package doaramacli
 
 import (
 	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/twpayne/go-doarama"
+	"github.com/twpayne/go-doarama/doaramacache"
 	"github.com/urfave/cli"
 )
 
@@ -37,6 +44,88 @@ var Flags = []cli.Flag{
 		Usage:  "Doarama user key",
 		EnvVar: "DOARAMA_USER_KEY",
 	},
+	cli.StringFlag{
+		Name:   "apikey-file",
+		Usage:  "file containing the Doarama API key",
+		EnvVar: "DOARAMA_API_KEY_FILE",
+	},
+	cli.StringFlag{
+		Name:   "apikey-command",
+		Usage:  "command that prints the Doarama API key",
+		EnvVar: "DOARAMA_API_KEY_COMMAND",
+	},
+	cli.StringFlag{
+		Name:   "userkey-file",
+		Usage:  "file containing the Doarama user key",
+		EnvVar: "DOARAMA_USER_KEY_FILE",
+	},
+	cli.StringFlag{
+		Name:   "userkey-command",
+		Usage:  "command that prints the Doarama user key",
+		EnvVar: "DOARAMA_USER_KEY_COMMAND",
+	},
+	cli.StringFlag{
+		Name:   "privacyzones",
+		Usage:  "privacy zones file",
+		EnvVar: "DOARAMA_PRIVACY_ZONES",
+	},
+	cli.BoolFlag{
+		Name:   "privacyjitter",
+		Usage:  "jitter samples in privacy zones instead of removing them",
+		EnvVar: "DOARAMA_PRIVACY_JITTER",
+	},
+	cli.StringFlag{
+		Name:   "cache",
+		Value:  defaultCache(),
+		Usage:  "activity cache",
+		EnvVar: "DOARAMA_CACHE",
+	},
+	cli.BoolFlag{
+		Name:  "no-cache",
+		Usage: "do not use the activity cache",
+	},
+	cli.BoolFlag{
+		Name:  "verify-cache",
+		Usage: "check that cached activities still exist before re-using them",
+	},
+	cli.DurationFlag{
+		Name:   "cache-ttl",
+		Usage:  "time after which cached activities are created again",
+		EnvVar: "DOARAMA_CACHE_TTL",
+	},
+	cli.BoolFlag{
+		Name:   "normalize-cache",
+		Usage:  "identify cached tracklogs by their samples rather than their bytes",
+		EnvVar: "DOARAMA_NORMALIZE_CACHE",
+	},
+	cli.StringFlag{
+		Name:   "config",
+		Value:  defaultConfig(),
+		Usage:  "configuration file",
+		EnvVar: "DOARAMA_CONFIG",
+	},
+	cli.StringFlag{
+		Name:   "profile",
+		Value:  DefaultProfile,
+		Usage:  "configuration profile",
+		EnvVar: "DOARAMA_PROFILE",
+	},
+	cli.StringFlag{
+		Name:   "output",
+		Value:  OutputText,
+		Usage:  "output format: json, text, or tsv",
+		EnvVar: "DOARAMA_OUTPUT",
+	},
+}
+
+// defaultCache returns the default activity cache, or the empty string if
+// there is no user cache directory.
+func defaultCache() string {
+	userCacheDir, err := os.UserCacheDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(userCacheDir, "doarama", "activities.sqlite3")
 }
 
 // ActivityTypeFlag specifies the activity type.
@@ -45,6 +134,25 @@ var ActivityTypeFlag = cli.StringFlag{
 	Usage: "activity type",
 }
 
+// FilterFlag specifies filters to apply to all samples.
+var FilterFlag = cli.StringSliceFlag{
+	Name:  "filter",
+	Usage: "filter to apply to all samples: speedgate=MAXSPEED, movingaverage=WINDOW, or altitudespike=MAXCLIMBRATE",
+}
+
+// JobsFlag specifies the number of parallel uploads.
+var JobsFlag = cli.IntFlag{
+	Name:  "jobs, j",
+	Value: 1,
+	Usage: "number of tracklogs to upload in parallel",
+}
+
+// TimeOffsetFlag specifies a time offset to add to all samples.
+var TimeOffsetFlag = cli.DurationFlag{
+	Name:  "time-offset",
+	Usage: "time offset to add to all samples",
+}
+
 // VisualisationFlags specify visualisation options.
 var VisualisationFlags = []cli.Flag{
 	cli.StringSliceFlag{
@@ -78,27 +186,129 @@ func ActivityType(c *cli.Context) string {
 	return c.String("activitytype")
 }
 
+// ParseFilter parses a filter of the form name=value.
+func ParseFilter(s string) (doarama.Filter, error) {
+	ss := strings.SplitN(s, "=", 2)
+	if len(ss) != 2 {
+		return nil, fmt.Errorf("%s: invalid filter", s)
+	}
+	value, err := strconv.ParseFloat(ss[1], 64)
+	if err != nil || value <= 0 {
+		return nil, fmt.Errorf("%s: invalid filter value", s)
+	}
+	switch ss[0] {
+	case "speedgate":
+		return &doarama.SpeedGate{MaxSpeed: value}, nil
+	case "movingaverage":
+		return &doarama.MovingAverage{Window: int(value)}, nil
+	case "altitudespike":
+		return &doarama.AltitudeSpikeFilter{MaxClimbRate: value}, nil
+	default:
+		return nil, fmt.Errorf("%s: unknown filter", s)
+	}
+}
+
+// Filters returns the filters from c.
+func Filters(c *cli.Context) (doarama.Pipeline, error) {
+	var pipeline doarama.Pipeline
+	for _, s := range c.StringSlice("filter") {
+		f, err := ParseFilter(s)
+		if err != nil {
+			return nil, err
+		}
+		pipeline = append(pipeline, f)
+	}
+	return pipeline, nil
+}
+
+// TimeOffset returns the time offset from c.
+func TimeOffset(c *cli.Context) time.Duration {
+	return c.Duration("time-offset")
+}
+
 // BaseDoaramaOptions returns the doarama.Options from c.
 func BaseDoaramaOptions(c *cli.Context) []doarama.ClientOption {
 	return []doarama.ClientOption{
-		doarama.APIURL(c.GlobalString("apiurl")),
-		doarama.APIName(c.GlobalString("apiname")),
-		doarama.APIKey(c.GlobalString("apikey")),
+		doarama.APIURL(globalString(c, "apiurl")),
+		doarama.APIName(globalString(c, "apiname")),
+		doarama.APIKey(globalString(c, "apikey")),
 	}
 }
 
+// NewDoaramaOptions returns the doarama.Options from c, with the API key read
+// from CredentialSources.
+func NewDoaramaOptions(c *cli.Context) ([]doarama.ClientOption, error) {
+	apiKey, err := Credential(c, "apikey")
+	if err != nil {
+		return nil, err
+	}
+	return append(BaseDoaramaOptions(c), doarama.APIKey(apiKey)), nil
+}
+
 // NewDoaramaClient returns a new doarama.Client constructed from c.
 func NewDoaramaClient(c *cli.Context) *doarama.Client {
 	options := BaseDoaramaOptions(c)
 	return doarama.NewClient(options...)
 }
 
+// PrivacyFilter returns the doarama.PrivacyFilter from c, or nil if no privacy
+// zones are specified.
+func PrivacyFilter(c *cli.Context) (*doarama.PrivacyFilter, error) {
+	filename := globalString(c, "privacyzones")
+	if filename == "" {
+		return nil, nil
+	}
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	zones, err := doarama.ReadPrivacyZones(f)
+	if err != nil {
+		return nil, err
+	}
+	return &doarama.PrivacyFilter{
+		Zones:  zones,
+		Jitter: globalBool(c, "privacyjitter"),
+	}, nil
+}
+
 // NewAuthenticatedDoaramaOptions returns the doaram.Options for an
 // authenticated doarama.Client from c.
 func NewAuthenticatedDoaramaOptions(c *cli.Context) ([]doarama.ClientOption, error) {
-	options := BaseDoaramaOptions(c)
-	userID := c.GlobalString("userid")
-	userKey := c.GlobalString("userkey")
+	options, err := NewDoaramaOptions(c)
+	if err != nil {
+		return nil, err
+	}
+	privacyFilter, err := PrivacyFilter(c)
+	if err != nil {
+		return nil, err
+	}
+	if privacyFilter != nil {
+		options = append(options, doarama.Privacy(privacyFilter))
+	}
+	// The user ID and user key are alternatives, so setting the user ID on
+	// the command line or in the environment overrides any user key.
+	// Otherwise the user key is read from CredentialSources, in the same
+	// order as the API key, and any user key overrides a user ID in the
+	// profile. The Secret Service is not asked for a user key when the
+	// profile has a user ID, as it may prompt to unlock the keyring.
+	var userID, userKey string
+	if c.GlobalIsSet("userid") {
+		userID, userKey = c.GlobalString("userid"), c.GlobalString("userkey")
+	} else {
+		userID = globalString(c, "userid")
+		last := OriginDefault
+		if userID != "" {
+			last = OriginProfile
+		}
+		if userKey, err = credential(c, "userkey", last); err != nil {
+			return nil, err
+		}
+		if userKey != "" {
+			userID = ""
+		}
+	}
 	switch {
 	case userID != "" && userKey == "":
 		options = append(options, doarama.Anonymous(userID))
@@ -120,6 +330,42 @@ func NewAuthenticatedDoaramaClient(c *cli.Context) (*doarama.Client, error) {
 	return doarama.NewClient(options...), nil
 }
 
+// NewActivityCreator returns a new doaramacache.ActivityCreator that creates
+// activities with client, using the activity cache from c unless it is
+// disabled.
+func NewActivityCreator(c *cli.Context, client *doarama.Client) (doaramacache.ActivityCreator, error) {
+	cache := globalString(c, "cache")
+	if globalBool(c, "no-cache") || cache == "" {
+		return client, nil
+	}
+	if err := os.MkdirAll(filepath.Dir(cache), 0700); err != nil {
+		return nil, err
+	}
+	return doaramacache.NewSQLite3(cache, client,
+		doaramacache.Normalize(globalBool(c, "normalize-cache")),
+		doaramacache.TTL(globalDuration(c, "cache-ttl")),
+		doaramacache.Verify(globalBool(c, "verify-cache")),
+	)
+}
+
+// VisualisationCreator returns ac if it also creates visualisations, for
+// example because it caches them, or client otherwise.
+func VisualisationCreator(ac doaramacache.ActivityCreator, client *doarama.Client) doaramacache.VisualisationCreator {
+	if vc, ok := ac.(doaramacache.VisualisationCreator); ok {
+		return vc
+	}
+	return client
+}
+
+// VisualisationManager returns ac if it also manages visualisations, for
+// example because it caches them, or client otherwise.
+func VisualisationManager(ac doaramacache.ActivityCreator, client *doarama.Client) doaramacache.VisualisationManager {
+	if vm, ok := ac.(doaramacache.VisualisationManager); ok {
+		return vm
+	}
+	return client
+}
+
 // NewVisualisationURLOptions returns a new doarama.VisualisationURLOptions
 // from c.
 func NewVisualisationURLOptions(c *cli.Context) *doarama.VisualisationURLOptions {
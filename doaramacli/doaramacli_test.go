@@ -0,0 +1,531 @@
+package doaramacli
+
+import (
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/twpayne/go-doarama"
+	"github.com/urfave/cli"
+)
+
+// run runs an app with the global flags, the profile, and args, calling
+// action.
+func run(t *testing.T, profile Profile, args []string, action func(*cli.Context) error) {
+	t.Helper()
+	filename := filepath.Join(t.TempDir(), "config.toml")
+	if profile != nil {
+		config := &Config{Profiles: map[string]Profile{DefaultProfile: profile}}
+		if err := config.Write(filename); err != nil {
+			t.Fatal(err)
+		}
+	}
+	app := cli.NewApp()
+	app.Flags = Flags
+	app.Before = LoadProfile
+	app.Action = action
+	app.Writer = ioutil.Discard
+	app.ErrWriter = ioutil.Discard
+	if err := app.Run(append([]string{"doarama", "--config", filename}, args...)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// fakeSecretService replaces the Secret Service with secrets, keyed by
+// credential name, and returns a pointer to the number of lookups.
+func fakeSecretService(t *testing.T, secrets map[string]string) *int {
+	lookups := 0
+	secretLookup = func(attributes map[string]string) (string, error) {
+		lookups++
+		return secrets[attributes["key"]], nil
+	}
+	t.Cleanup(func() {
+		secretLookup = lookupSecret
+	})
+	return &lookups
+}
+
+// writeFile writes data to a new file with permissions perm and returns its
+// name.
+func writeFile(t *testing.T, data string, perm os.FileMode) string {
+	t.Helper()
+	filename := filepath.Join(t.TempDir(), "credential")
+	if err := ioutil.WriteFile(filename, []byte(data), perm); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(filename, perm); err != nil {
+		t.Fatal(err)
+	}
+	return filename
+}
+
+func TestFileCredential(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("file permissions are not checked on Windows")
+	}
+	for _, tc := range []struct {
+		name    string
+		data    string
+		perm    os.FileMode
+		want    string
+		wantErr bool
+	}{
+		{name: "private", data: "secret\n", perm: 0600, want: "secret"},
+		{name: "read_only", data: "secret\n", perm: 0400, want: "secret"},
+		{name: "group_readable", data: "secret\n", perm: 0640, wantErr: true},
+		{name: "world_readable", data: "secret\n", perm: 0644, wantErr: true},
+		{name: "empty", data: "\n", perm: 0600, wantErr: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			filename := writeFile(t, tc.data, tc.perm)
+			run(t, nil, []string{"--apikey-file", filename}, func(c *cli.Context) error {
+				if got, err := Credential(c, "apikey"); got != tc.want || (err != nil) != tc.wantErr {
+					t.Errorf("Credential(c, %q) == %q, %v, want %q, error %t", "apikey", got, err, tc.want, tc.wantErr)
+				}
+				return nil
+			})
+		})
+	}
+}
+
+func TestCommandCredential(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("commands are run with cmd on Windows")
+	}
+	for _, tc := range []struct {
+		name    string
+		command string
+		want    string
+		wantErr bool
+	}{
+		{name: "output", command: "echo secret", want: "secret"},
+		{name: "trimmed", command: "printf ' secret\\n\\n'", want: "secret"},
+		{name: "no_output", command: "true", wantErr: true},
+		{name: "failure", command: "echo secret; exit 1", wantErr: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			run(t, nil, []string{"--userkey-command", tc.command}, func(c *cli.Context) error {
+				if got, err := Credential(c, "userkey"); got != tc.want || (err != nil) != tc.wantErr {
+					t.Errorf("Credential(c, %q) == %q, %v, want %q, error %t", "userkey", got, err, tc.want, tc.wantErr)
+				}
+				return nil
+			})
+		})
+	}
+}
+
+func TestCredentialPrecedence(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("commands are run with cmd on Windows")
+	}
+	envVars := map[string]string{
+		"apikey":          "DOARAMA_API_KEY",
+		"apikey-file":     "DOARAMA_API_KEY_FILE",
+		"apikey-command":  "DOARAMA_API_KEY_COMMAND",
+		"userkey":         "DOARAMA_USER_KEY",
+		"userkey-file":    "DOARAMA_USER_KEY_FILE",
+		"userkey-command": "DOARAMA_USER_KEY_COMMAND",
+	}
+	// A setting sets the credential with the source that reads the flag with
+	// suffix, from origin. The credential is origin+suffix, for example
+	// "env-file".
+	type setting struct {
+		origin string
+		suffix string
+	}
+	for _, tc := range []struct {
+		name        string
+		settings    []setting
+		secret      string
+		want        string
+		wantLookups int
+	}{
+		{
+			name:     "flag",
+			settings: []setting{{"flag", ""}, {"flag", "-file"}, {"flag", "-command"}, {"env", ""}, {"profile", ""}},
+			secret:   "secret",
+			want:     "flag",
+		},
+		{
+			name:     "flag_file_beats_env",
+			settings: []setting{{"env", ""}, {"flag", "-file"}},
+			want:     "flag-file",
+		},
+		{
+			name:     "flag_command_beats_profile",
+			settings: []setting{{"profile", ""}, {"flag", "-command"}},
+			want:     "flag-command",
+		},
+		{
+			name:     "env",
+			settings: []setting{{"env", ""}, {"env", "-file"}, {"profile", ""}},
+			want:     "env",
+		},
+		{
+			name:     "env_command_beats_profile",
+			settings: []setting{{"profile", ""}, {"profile", "-file"}, {"env", "-command"}},
+			want:     "env-command",
+		},
+		{
+			name:     "env_file_beats_env_command",
+			settings: []setting{{"env", "-command"}, {"env", "-file"}},
+			want:     "env-file",
+		},
+		{
+			name:     "profile",
+			settings: []setting{{"profile", ""}, {"profile", "-file"}, {"profile", "-command"}},
+			secret:   "secret",
+			want:     "profile",
+		},
+		{
+			name:     "profile_file",
+			settings: []setting{{"profile", "-file"}, {"profile", "-command"}},
+			want:     "profile-file",
+		},
+		{
+			name:     "profile_command",
+			settings: []setting{{"profile", "-command"}},
+			secret:   "secret",
+			want:     "profile-command",
+		},
+		{
+			name:        "secret_service",
+			secret:      "secret",
+			want:        "secret",
+			wantLookups: 1,
+		},
+		{
+			name:        "none",
+			wantLookups: 1,
+		},
+	} {
+		for _, key := range []string{"apikey", "userkey"} {
+			t.Run(tc.name+"_"+key, func(t *testing.T) {
+				lookups := fakeSecretService(t, map[string]string{key: tc.secret})
+				var args []string
+				var profile Profile
+				for _, s := range tc.settings {
+					value := s.origin + s.suffix
+					switch s.suffix {
+					case "-file":
+						value = writeFile(t, value, 0600)
+					case "-command":
+						value = "echo " + value
+					}
+					switch s.origin {
+					case "flag":
+						args = append(args, "--"+key+s.suffix, value)
+					case "env":
+						t.Setenv(envVars[key+s.suffix], value)
+					case "profile":
+						if profile == nil {
+							profile = Profile{}
+						}
+						profile[strings.Replace(key+s.suffix, "-", "_", -1)] = value
+					}
+				}
+				run(t, profile, args, func(c *cli.Context) error {
+					if got, err := Credential(c, key); got != tc.want || err != nil {
+						t.Errorf("Credential(c, %q) == %q, %v, want %q, <nil>", key, got, err, tc.want)
+					}
+					return nil
+				})
+				if *lookups != tc.wantLookups {
+					t.Errorf("got %d Secret Service lookups, want %d", *lookups, tc.wantLookups)
+				}
+			})
+		}
+	}
+}
+
+func TestNewAuthenticatedDoaramaOptions(t *testing.T) {
+	for _, tc := range []struct {
+		name         string
+		args         []string
+		profile      Profile
+		secrets      map[string]string
+		wantIdentity string
+		wantErr      bool
+		wantLookups  int
+	}{
+		{
+			name:         "userid_flag",
+			args:         []string{"--userid", "u"},
+			secrets:      map[string]string{"userkey": "secret"},
+			wantIdentity: "user-id:u",
+		},
+		{
+			name:         "userkey_flag",
+			args:         []string{"--userkey", "k"},
+			profile:      Profile{"userid": "u"},
+			wantIdentity: doarama.NewClient(doarama.Delegate("k")).Identity(),
+		},
+		{
+			name:         "userkey_file_overrides_profile_userid",
+			args:         []string{"--userkey-file", "FILE"},
+			profile:      Profile{"userid": "u"},
+			wantIdentity: doarama.NewClient(doarama.Delegate("file")).Identity(),
+		},
+		{
+			name:         "profile_userid_skips_secret_service",
+			profile:      Profile{"userid": "u"},
+			secrets:      map[string]string{"userkey": "secret"},
+			wantIdentity: "user-id:u",
+		},
+		{
+			name:         "secret_service_without_userid",
+			secrets:      map[string]string{"userkey": "secret"},
+			wantIdentity: doarama.NewClient(doarama.Delegate("secret")).Identity(),
+			wantLookups:  1,
+		},
+		{
+			name:    "userid_and_userkey",
+			args:    []string{"--userid", "u", "--userkey", "k"},
+			wantErr: true,
+		},
+		{
+			name:        "neither",
+			wantErr:     true,
+			wantLookups: 1,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			lookups := fakeSecretService(t, tc.secrets)
+			args := []string{"--apikey", "apikey"}
+			for _, arg := range tc.args {
+				if arg == "FILE" {
+					arg = writeFile(t, "file", 0600)
+				}
+				args = append(args, arg)
+			}
+			run(t, tc.profile, args, func(c *cli.Context) error {
+				options, err := NewAuthenticatedDoaramaOptions(c)
+				if (err != nil) != tc.wantErr {
+					t.Fatalf("NewAuthenticatedDoaramaOptions(c) == %v, %v, want error %t", options, err, tc.wantErr)
+				}
+				if err != nil {
+					return nil
+				}
+				if got := doarama.NewClient(options...).Identity(); got != tc.wantIdentity {
+					t.Errorf("identity == %q, want %q", got, tc.wantIdentity)
+				}
+				return nil
+			})
+			if *lookups != tc.wantLookups {
+				t.Errorf("got %d Secret Service lookups, want %d", *lookups, tc.wantLookups)
+			}
+		})
+	}
+}
+
+func TestGlobalString(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		args    []string
+		env     string
+		profile Profile
+		want    string
+	}{
+		{
+			name:    "flag",
+			args:    []string{"--apiurl", "flag"},
+			env:     "env",
+			profile: Profile{"apiurl": "profile"},
+			want:    "flag",
+		},
+		{
+			name:    "env",
+			env:     "env",
+			profile: Profile{"apiurl": "profile"},
+			want:    "env",
+		},
+		{
+			name:    "profile",
+			profile: Profile{"apiurl": "profile"},
+			want:    "profile",
+		},
+		{
+			name: "default",
+			want: doarama.DefaultAPIURL,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if tc.env != "" {
+				t.Setenv("DOARAMA_API_URL", tc.env)
+			}
+			run(t, tc.profile, tc.args, func(c *cli.Context) error {
+				if got := globalString(c, "apiurl"); got != tc.want {
+					t.Errorf("globalString(c, %q) == %q, want %q", "apiurl", got, tc.want)
+				}
+				return nil
+			})
+		})
+	}
+}
+
+func TestGlobalBoolAndDuration(t *testing.T) {
+	for _, tc := range []struct {
+		name         string
+		args         []string
+		profile      Profile
+		wantJitter   bool
+		wantNoCache  bool
+		wantCacheTTL time.Duration
+	}{
+		{
+			name: "default",
+		},
+		{
+			name: "profile",
+			profile: Profile{
+				"cache_ttl":     "720h",
+				"no_cache":      "true",
+				"privacyjitter": "true",
+			},
+			wantJitter:   true,
+			wantNoCache:  true,
+			wantCacheTTL: 720 * time.Hour,
+		},
+		{
+			name: "flag",
+			args: []string{"--privacyjitter=false", "--no-cache", "--cache-ttl", "1h"},
+			profile: Profile{
+				"cache_ttl":     "720h",
+				"no_cache":      "false",
+				"privacyjitter": "true",
+			},
+			wantNoCache:  true,
+			wantCacheTTL: time.Hour,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			run(t, tc.profile, tc.args, func(c *cli.Context) error {
+				if got := globalBool(c, "privacyjitter"); got != tc.wantJitter {
+					t.Errorf("globalBool(c, %q) == %t, want %t", "privacyjitter", got, tc.wantJitter)
+				}
+				if got := globalBool(c, "no-cache"); got != tc.wantNoCache {
+					t.Errorf("globalBool(c, %q) == %t, want %t", "no-cache", got, tc.wantNoCache)
+				}
+				if got := globalDuration(c, "cache-ttl"); got != tc.wantCacheTTL {
+					t.Errorf("globalDuration(c, %q) == %v, want %v", "cache-ttl", got, tc.wantCacheTTL)
+				}
+				return nil
+			})
+		})
+	}
+}
+
+func TestReadConfig(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		data    string
+		want    Profile
+		wantErr bool
+	}{
+		{
+			name: "strings",
+			data: "[profiles.default]\napiname = \"name\"\nno_cache = \"true\"\ncache_ttl = \"1h\"\n",
+			want: Profile{"apiname": "name", "no_cache": "true", "cache_ttl": "1h"},
+		},
+		{
+			name: "bool",
+			data: "[profiles.default]\nprivacyjitter = true\nverify_cache = false\n",
+			want: Profile{"privacyjitter": "true", "verify_cache": "false"},
+		},
+		{
+			name:    "unknown_key",
+			data:    "[profiles.default]\njitter = true\n",
+			wantErr: true,
+		},
+		{
+			name:    "invalid_bool",
+			data:    "[profiles.default]\nno_cache = \"maybe\"\n",
+			wantErr: true,
+		},
+		{
+			name:    "invalid_duration",
+			data:    "[profiles.default]\ncache_ttl = 3600\n",
+			wantErr: true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			filename := filepath.Join(t.TempDir(), "config.toml")
+			if err := ioutil.WriteFile(filename, []byte(tc.data), 0600); err != nil {
+				t.Fatal(err)
+			}
+			config, err := ReadConfig(filename)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("ReadConfig(%q) == %v, %v, want error %t", filename, config, err, tc.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if got := config.Profiles[DefaultProfile]; !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("ReadConfig(%q).Profiles[%q] == %v, want %v", filename, DefaultProfile, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestOutputErr(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		format  string
+		records []*Record
+		wantErr bool
+	}{
+		{name: "text_ok", format: OutputText, records: []*Record{{Type: "activity", Text: "ActivityId: 1"}}},
+		{name: "text_failed", format: OutputText, records: []*Record{{Type: "activity", Err: errors.New("failed")}, {Type: "activity", Text: "ActivityId: 2"}}, wantErr: true},
+		{name: "json_ok", format: OutputJSON, records: []*Record{{Type: "activity"}}},
+		{name: "json_failed", format: OutputJSON, records: []*Record{{Type: "activity"}, {Type: "activity", Err: errors.New("failed")}}, wantErr: true},
+		{name: "tsv_failed", format: OutputTSV, records: []*Record{{Type: "activity", Err: errors.New("failed")}}, wantErr: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			log.SetOutput(ioutil.Discard)
+			defer log.SetOutput(os.Stderr)
+			out := &Output{format: tc.format, w: ioutil.Discard}
+			for _, r := range tc.records {
+				if err := out.Write(r); err != nil {
+					t.Fatal(err)
+				}
+			}
+			err := out.Err()
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("out.Err() == %v, want error %v", err, tc.wantErr)
+			}
+			if ec, ok := err.(cli.ExitCoder); err != nil && (!ok || ec.ExitCode() == 0 || ec.Error() != "") {
+				t.Errorf("out.Err() == %#v, want a silent non-zero exit", err)
+			}
+		})
+	}
+}
+
+func TestProgressBarsSameBaseName(t *testing.T) {
+	p := &ProgressBars{
+		w:      ioutil.Discard,
+		byName: make(map[string]*fileProgress),
+	}
+	a, b := filepath.Join("a", "x.igc"), filepath.Join("b", "x.igc")
+	p.Add(a, 100)
+	p.Add(b, 200)
+	p.Update(a, 50, 100)
+	p.Finish(b)
+	if len(p.files) != 2 {
+		t.Fatalf("len(p.files) == %d, want 2", len(p.files))
+	}
+	for i, want := range []fileProgress{
+		{name: "x.igc", sent: 50, total: 100},
+		{name: "x.igc", sent: 200, total: 200, done: true},
+	} {
+		if got := p.files[i]; got.name != want.name || got.sent != want.sent || got.total != want.total || got.done != want.done {
+			t.Errorf("p.files[%d] == %+v, want %+v", i, got, want)
+		}
+	}
+}
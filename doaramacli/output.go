@@ -0,0 +1,189 @@
+package doaramacli
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/urfave/cli"
+)
+
+// Output formats.
+const (
+	OutputJSON = "json"
+	OutputText = "text"
+	OutputTSV  = "tsv"
+)
+
+// A Field is a named value in a Record.
+type Field struct {
+	Name  string
+	Value interface{}
+}
+
+// A Record is an item of command output, such as an activity or a
+// visualisation, or the failure to create one.
+type Record struct {
+	// Type is the type of the record, for example "activity".
+	Type string
+	// File is the input file that the record describes, if any.
+	File string
+	// Fields are the values of the record.
+	Fields []Field
+	// Err is the error, if any.
+	Err error
+	// Text is the record in text format. Records without Text and without
+	// Err are not shown in text format.
+	Text string
+}
+
+// An Output writes records in a format chosen by the user.
+type Output struct {
+	format string
+	w      io.Writer
+	failed bool
+}
+
+// NewOutput returns a new Output that writes to the standard output in the
+// format specified by the --output flag in c.
+func NewOutput(c *cli.Context) (*Output, error) {
+	format := globalString(c, "output")
+	switch format {
+	case "":
+		format = OutputText
+	case OutputJSON, OutputText, OutputTSV:
+	default:
+		return nil, fmt.Errorf("%s: unknown output format", format)
+	}
+	return &Output{
+		format: format,
+		w:      os.Stdout,
+	}, nil
+}
+
+// jsonKey returns the JSON key of name, which is name with its first letter
+// in lower case.
+func jsonKey(name string) string {
+	r, n := utf8.DecodeRuneInString(name)
+	return string(unicode.ToLower(r)) + name[n:]
+}
+
+// tsvValue returns v formatted as a TSV value.
+func tsvValue(v interface{}) string {
+	return strings.NewReplacer("\t", " ", "\n", " ").Replace(fmt.Sprint(v))
+}
+
+// Write writes r. In text format, errors are logged to the standard error
+// rather than written.
+func (o *Output) Write(r *Record) error {
+	if r.Err != nil {
+		o.failed = true
+	}
+	switch o.format {
+	case OutputJSON:
+		var b bytes.Buffer
+		b.WriteByte('{')
+		add := func(key string, value interface{}) error {
+			if b.Len() > 1 {
+				b.WriteByte(',')
+			}
+			var data bytes.Buffer
+			e := json.NewEncoder(&data)
+			e.SetEscapeHTML(false)
+			if err := e.Encode(value); err != nil {
+				return err
+			}
+			fmt.Fprintf(&b, "%q:%s", key, bytes.TrimSuffix(data.Bytes(), []byte("\n")))
+			return nil
+		}
+		add("type", r.Type)
+		if r.File != "" {
+			add("file", r.File)
+		}
+		for _, f := range r.Fields {
+			if err := add(jsonKey(f.Name), f.Value); err != nil {
+				return err
+			}
+		}
+		if r.Err != nil {
+			add("error", r.Err.Error())
+		}
+		b.WriteString("}\n")
+		_, err := o.w.Write(b.Bytes())
+		return err
+	case OutputTSV:
+		values := []string{r.Type, tsvValue(r.File), ""}
+		if r.Err != nil {
+			values[2] = tsvValue(r.Err)
+		}
+		for _, f := range r.Fields {
+			values = append(values, tsvValue(f.Value))
+		}
+		_, err := fmt.Fprintln(o.w, strings.Join(values, "\t"))
+		return err
+	default:
+		if r.Err != nil {
+			log.Print(r.Err)
+			return nil
+		}
+		if r.Text == "" {
+			return nil
+		}
+		_, err := fmt.Fprintln(o.w, r.Text)
+		return err
+	}
+}
+
+// Fail reports that a command failed with err. In text format it returns err.
+// Otherwise it writes records, or a single error record if records is empty,
+// and returns an error that makes the command exit with a non-zero status
+// without printing anything more.
+func (o *Output) Fail(err error, records ...*Record) error {
+	if o.format == OutputText {
+		return err
+	}
+	if len(records) == 0 {
+		records = []*Record{{Type: "error", Err: err}}
+	}
+	for _, r := range records {
+		if err := o.Write(r); err != nil {
+			return err
+		}
+	}
+	return cli.NewExitError("", 1)
+}
+
+// Err returns an error that makes the command exit with a non-zero status
+// without printing anything more if any record written had an error, and nil
+// otherwise.
+func (o *Output) Err() error {
+	if o.failed {
+		return cli.NewExitError("", 1)
+	}
+	return nil
+}
+
+// HandleExitErr handles an error returned by a command. It is a
+// cli.ExitErrHandlerFunc. If the output format is not text then it writes err
+// as an error record and exits with a non-zero status. Otherwise it leaves
+// err to be returned by cli.App.Run.
+func HandleExitErr(c *cli.Context, err error) {
+	if err == nil {
+		return
+	}
+	if _, ok := err.(cli.ExitCoder); ok {
+		cli.HandleExitCoder(err)
+		return
+	}
+	out, outErr := NewOutput(c)
+	if outErr != nil || out.format == OutputText {
+		return
+	}
+	cli.HandleExitCoder(out.Fail(err))
+}
@@ -0,0 +1,203 @@
+package doaramacli
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// progressBarWidth is the width of each progress bar in characters.
+const progressBarWidth = 30
+
+// progressInterval is the minimum interval between redraws.
+const progressInterval = 100 * time.Millisecond
+
+// A fileProgress is the progress of a single file.
+type fileProgress struct {
+	name  string // The base name, for display.
+	sent  int64
+	total int64
+	start time.Time
+	done  bool
+}
+
+// A ProgressBars draws per-file and overall upload progress bars. A nil
+// *ProgressBars draws nothing, so callers do not need to check whether
+// progress bars are enabled.
+type ProgressBars struct {
+	mu       sync.Mutex
+	w        io.Writer
+	start    time.Time
+	files    []*fileProgress
+	byName   map[string]*fileProgress // Keyed by the whole filename.
+	lines    int
+	lastDraw time.Time
+}
+
+// isTerminal returns whether f is a terminal.
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+// NewProgressBars returns a new ProgressBars that draws on stderr, or nil if
+// stdout or stderr is not a terminal.
+func NewProgressBars() *ProgressBars {
+	if !isTerminal(os.Stdout) || !isTerminal(os.Stderr) {
+		return nil
+	}
+	return &ProgressBars{
+		w:      os.Stderr,
+		start:  time.Now(),
+		byName: make(map[string]*fileProgress),
+	}
+}
+
+// file returns the progress of name, adding it if needed. Files are
+// identified by their whole name, so files with the same base name in
+// different directories have different progress bars. p must be locked.
+func (p *ProgressBars) file(name string) *fileProgress {
+	f, ok := p.byName[name]
+	if !ok {
+		f = &fileProgress{
+			name:  filepath.Base(name),
+			total: -1,
+		}
+		p.files = append(p.files, f)
+		p.byName[name] = f
+	}
+	return f
+}
+
+// Add adds name, with size bytes, to the files shown, so that it is included
+// in the overall progress before its upload starts.
+func (p *ProgressBars) Add(name string, size int64) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.file(name).total = size
+}
+
+// Update updates the progress of name. It has the signature of a
+// doarama.ProgressFunc.
+func (p *ProgressBars) Update(name string, sent, total int64) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	f := p.file(name)
+	if f.start.IsZero() || sent < f.sent {
+		f.start = time.Now()
+	}
+	f.sent = sent
+	if total >= 0 {
+		f.total = total
+	}
+	if now := time.Now(); now.Sub(p.lastDraw) >= progressInterval || sent == total {
+		p.draw(now)
+	}
+}
+
+// Finish marks name as complete, whether or not it was uploaded.
+func (p *ProgressBars) Finish(name string) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	f := p.file(name)
+	f.done = true
+	if f.total < 0 {
+		f.total = f.sent
+	}
+	f.sent = f.total
+	p.draw(time.Now())
+}
+
+// Close clears the progress bars.
+func (p *ProgressBars) Close() error {
+	if p == nil {
+		return nil
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.clear()
+	return nil
+}
+
+// clear erases the lines drawn. p must be locked.
+func (p *ProgressBars) clear() {
+	if p.lines > 0 {
+		fmt.Fprintf(p.w, "\x1b[%dA\x1b[J", p.lines)
+		p.lines = 0
+	}
+}
+
+// draw redraws the progress bars. p must be locked.
+func (p *ProgressBars) draw(now time.Time) {
+	p.clear()
+	var sent, total int64
+	known := true
+	for _, f := range p.files {
+		fmt.Fprintln(p.w, progressLine(f.name, f.sent, f.total, now.Sub(f.start), f.start.IsZero() || f.done))
+		sent += f.sent
+		if f.total < 0 {
+			known = false
+		}
+		total += f.total
+	}
+	if !known {
+		total = -1
+	}
+	fmt.Fprintln(p.w, progressLine("Total", sent, total, now.Sub(p.start), false))
+	p.lines = len(p.files) + 1
+	p.lastDraw = now
+}
+
+// progressLine returns a line showing that sent of total bytes were sent in
+// elapsed. If idle is true then the rate and ETA are omitted.
+func progressLine(name string, sent, total int64, elapsed time.Duration, idle bool) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%-20.20s ", name)
+	if total > 0 {
+		n := int(int64(progressBarWidth) * sent / total)
+		if n > progressBarWidth {
+			n = progressBarWidth
+		}
+		fmt.Fprintf(&b, "[%s%s] %3d%% ", strings.Repeat("=", n), strings.Repeat(" ", progressBarWidth-n), 100*sent/total)
+		fmt.Fprintf(&b, "%s/%s", formatBytes(sent), formatBytes(total))
+	} else {
+		fmt.Fprintf(&b, "%s", formatBytes(sent))
+	}
+	if idle || elapsed <= 0 || sent <= 0 {
+		return b.String()
+	}
+	rate := float64(sent) / elapsed.Seconds()
+	fmt.Fprintf(&b, " %s/s", formatBytes(int64(rate)))
+	if total > sent {
+		eta := time.Duration(float64(total-sent) / rate * float64(time.Second))
+		fmt.Fprintf(&b, " ETA %s", eta.Round(time.Second))
+	}
+	return b.String()
+}
+
+// formatBytes returns n in human-readable binary units.
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,154 @@
+package doaramacli
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/godbus/dbus/v5"
+)
+
+const (
+	secretServiceName      = "org.freedesktop.secrets"
+	secretServicePath      = "/org/freedesktop/secrets"
+	secretServiceInterface = "org.freedesktop.Secret.Service"
+	secretPromptInterface  = "org.freedesktop.Secret.Prompt"
+)
+
+// Secret Service timeouts. The prompt timeout is longer as it includes the
+// time that the user takes to unlock their keyring.
+var (
+	secretServiceTimeout       = 5 * time.Second
+	secretServicePromptTimeout = 2 * time.Minute
+)
+
+// A secret is a secret returned by the Secret Service.
+type secret struct {
+	Session     dbus.ObjectPath
+	Parameters  []byte
+	Value       []byte
+	ContentType string
+}
+
+// sessionBusAddress returns the address of the session bus, or the empty
+// string if there is none. Unlike dbus.ConnectSessionBus, it never launches a
+// new bus.
+func sessionBusAddress() string {
+	if address := os.Getenv("DBUS_SESSION_BUS_ADDRESS"); address != "" && address != "autolaunch:" {
+		return address
+	}
+	if runtimeDir := os.Getenv("XDG_RUNTIME_DIR"); runtimeDir != "" {
+		path := filepath.Join(runtimeDir, "bus")
+		if _, err := os.Stat(path); err == nil {
+			return "unix:path=" + path
+		}
+	}
+	return ""
+}
+
+// call calls method on obj, giving up after secretServiceTimeout.
+func call(ctx context.Context, obj dbus.BusObject, method string, args ...interface{}) *dbus.Call {
+	ctx, cancel := context.WithTimeout(ctx, secretServiceTimeout)
+	defer cancel()
+	return obj.CallWithContext(ctx, method, 0, args...)
+}
+
+// lookupSecret returns the value of the first secret in the Secret Service
+// with attributes, unlocking it if needed. It returns the empty string if the
+// Secret Service is not available or has no such secret. Each D-Bus call
+// times out after secretServiceTimeout, and the whole lookup, including any
+// prompt to unlock the keyring, after secretServicePromptTimeout.
+func lookupSecret(attributes map[string]string) (string, error) {
+	address := sessionBusAddress()
+	if address == "" {
+		return "", nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), secretServicePromptTimeout)
+	defer cancel()
+	// The connection is closed when ctx is done, so cancelling ctx also
+	// stops a connection attempt that hangs.
+	connectTimer := time.AfterFunc(secretServiceTimeout, cancel)
+	conn, err := dbus.Connect(address, dbus.WithContext(ctx))
+	connectTimer.Stop()
+	if err != nil {
+		return "", nil
+	}
+	defer conn.Close()
+	service := conn.Object(secretServiceName, secretServicePath)
+	var output dbus.Variant
+	var session dbus.ObjectPath
+	if err := call(ctx, service, secretServiceInterface+".OpenSession", "plain", dbus.MakeVariant("")).Store(&output, &session); err != nil {
+		return "", nil
+	}
+	defer call(ctx, conn.Object(secretServiceName, session), "org.freedesktop.Secret.Session.Close")
+	var unlocked, locked []dbus.ObjectPath
+	if err := call(ctx, service, secretServiceInterface+".SearchItems", attributes).Store(&unlocked, &locked); err != nil {
+		return "", err
+	}
+	if len(unlocked) == 0 && len(locked) != 0 {
+		if unlocked, err = unlockSecrets(ctx, conn, service, locked[:1]); err != nil {
+			return "", err
+		}
+	}
+	if len(unlocked) == 0 {
+		return "", nil
+	}
+	var s secret
+	if err := call(ctx, conn.Object(secretServiceName, unlocked[0]), "org.freedesktop.Secret.Item.GetSecret", session).Store(&s); err != nil {
+		return "", err
+	}
+	return string(s.Value), nil
+}
+
+// unlockSecrets unlocks items, prompting the user if needed, and returns the
+// items that were unlocked.
+func unlockSecrets(ctx context.Context, conn *dbus.Conn, service dbus.BusObject, items []dbus.ObjectPath) ([]dbus.ObjectPath, error) {
+	var unlocked []dbus.ObjectPath
+	var prompt dbus.ObjectPath
+	if err := call(ctx, service, secretServiceInterface+".Unlock", items).Store(&unlocked, &prompt); err != nil {
+		return nil, err
+	}
+	if prompt == "/" {
+		return unlocked, nil
+	}
+	if err := conn.AddMatchSignal(
+		dbus.WithMatchObjectPath(prompt),
+		dbus.WithMatchInterface(secretPromptInterface),
+		dbus.WithMatchMember("Completed"),
+	); err != nil {
+		return nil, err
+	}
+	signals := make(chan *dbus.Signal, 1)
+	conn.Signal(signals)
+	defer conn.RemoveSignal(signals)
+	if err := call(ctx, conn.Object(secretServiceName, prompt), secretPromptInterface+".Prompt", "").Err; err != nil {
+		return nil, err
+	}
+	for {
+		var signal *dbus.Signal
+		var ok bool
+		select {
+		case signal, ok = <-signals:
+		case <-ctx.Done():
+			return nil, errors.New("secret service: unlock timed out")
+		}
+		if !ok {
+			return nil, errors.New("secret service: connection closed")
+		}
+		if signal.Path != prompt || signal.Name != secretPromptInterface+".Completed" {
+			continue
+		}
+		var dismissed bool
+		var result dbus.Variant
+		if err := dbus.Store(signal.Body, &dismissed, &result); err != nil {
+			return nil, err
+		}
+		if dismissed {
+			return nil, errors.New("secret service: unlock dismissed")
+		}
+		unlocked, _ = result.Value().([]dbus.ObjectPath)
+		return unlocked, nil
+	}
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+// +build !linux
+
+package doaramacli
+
+// lookupSecret returns the empty string as the Secret Service is not
+// available on this platform.
+func lookupSecret(attributes map[string]string) (string, error) {
+	return "", nil
+}
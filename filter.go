@@ -0,0 +1,177 @@
+package doarama
+
+// A Filter transforms a sequence of samples. Filters do not modify their
+// input.
+type Filter interface {
+	Apply([]Sample) []Sample
+}
+
+// A FilterFunc is a function that implements Filter.
+type FilterFunc func([]Sample) []Sample
+
+// A Pipeline is a sequence of filters applied in order.
+type Pipeline []Filter
+
+// reanchorRun is the number of consecutive samples that must agree with each
+// other, but not with the samples before them, before SpeedGate and
+// AltitudeSpikeFilter decide that the earlier samples are wrong.
+const reanchorRun = 3
+
+// A SpeedGate removes samples that would require a horizontal speed greater
+// than MaxSpeed, in meters per second, to reach from the previous sample.
+// If the samples that it has kept are outnumbered by a run of at least three
+// consecutive samples that agree with each other but not with them, for
+// example because the first sample is wrong, then it removes the kept samples
+// instead.
+type SpeedGate struct {
+	MaxSpeed float64
+}
+
+// A MovingAverage smooths positions and altitudes with a centered moving
+// average over Window samples. When Window is even, the window includes one
+// more sample before each sample than after it. Windows are truncated at the
+// start and end of the samples.
+type MovingAverage struct {
+	Window int
+}
+
+// An AltitudeSpikeFilter replaces altitudes that would require a vertical
+// speed greater than MaxClimbRate, in meters per second, with altitudes
+// interpolated from the neighbouring samples. Like SpeedGate, it decides
+// which altitudes are wrong by the majority of a run of at least three
+// consecutive samples, so a wrong first altitude is replaced too.
+type AltitudeSpikeFilter struct {
+	MaxClimbRate float64
+}
+
+// Apply implements Filter.
+func (f FilterFunc) Apply(samples []Sample) []Sample {
+	return f(samples)
+}
+
+// Apply implements Filter.
+func (p Pipeline) Apply(samples []Sample) []Sample {
+	for _, f := range p {
+		samples = f.Apply(samples)
+	}
+	return samples
+}
+
+// seconds returns the time from s0 to s1 in seconds.
+func seconds(s0, s1 *Sample) float64 {
+	return float64(s1.Time-s0.Time) / 1000
+}
+
+// consistent returns the indexes of the samples that agree with each other
+// according to agree. Each sample is kept if it agrees with the last kept
+// sample. Otherwise, once at least reanchorRun consecutive samples that were
+// not kept agree with each other, they are kept in place of the last kept
+// samples that they disagree with, as long as there are fewer of those.
+func consistent(samples []Sample, agree func(s0, s1 *Sample) bool) []int {
+	var kept, run []int
+	for i := range samples {
+		if n := len(kept); n == 0 || agree(&samples[kept[n-1]], &samples[i]) {
+			kept = append(kept, i)
+			run = run[:0]
+			continue
+		}
+		if n := len(run); n > 0 && agree(&samples[run[n-1]], &samples[i]) {
+			run = append(run, i)
+		} else {
+			run = append(run[:0], i)
+		}
+		if len(run) < reanchorRun {
+			continue
+		}
+		j := len(kept)
+		for j > 0 && len(kept)-j < len(run) && !agree(&samples[kept[j-1]], &samples[run[0]]) {
+			j--
+		}
+		if len(kept)-j < len(run) {
+			kept = append(kept[:j], run...)
+			run = run[:0]
+		}
+	}
+	return kept
+}
+
+// Apply implements Filter.
+func (f *SpeedGate) Apply(samples []Sample) []Sample {
+	kept := consistent(samples, func(s0, s1 *Sample) bool {
+		d := distance(s0.Coords.Latitude, s0.Coords.Longitude, s1.Coords.Latitude, s1.Coords.Longitude)
+		dt := seconds(s0, s1)
+		return dt > 0 && d/dt <= f.MaxSpeed
+	})
+	result := make([]Sample, len(kept))
+	for i, j := range kept {
+		result[i] = samples[j]
+	}
+	return result
+}
+
+// Apply implements Filter.
+func (f *MovingAverage) Apply(samples []Sample) []Sample {
+	result := make([]Sample, len(samples))
+	copy(result, samples)
+	if f.Window <= 1 {
+		return result
+	}
+	for i := range result {
+		lo := i - f.Window/2
+		hi := lo + f.Window - 1
+		if lo < 0 {
+			lo = 0
+		}
+		if hi > len(samples)-1 {
+			hi = len(samples) - 1
+		}
+		var lat, lng, alt float64
+		for _, s := range samples[lo : hi+1] {
+			lat += s.Coords.Latitude
+			lng += s.Coords.Longitude
+			alt += s.Coords.Altitude
+		}
+		n := float64(hi - lo + 1)
+		result[i].Coords.Latitude = lat / n
+		result[i].Coords.Longitude = lng / n
+		result[i].Coords.Altitude = alt / n
+	}
+	return result
+}
+
+// climbRate returns the vertical speed from s0 to s1 in meters per second.
+func climbRate(s0, s1 *Sample) float64 {
+	dt := seconds(s0, s1)
+	if dt <= 0 {
+		return 0
+	}
+	return (s1.Coords.Altitude - s0.Coords.Altitude) / dt
+}
+
+// Apply implements Filter.
+func (f *AltitudeSpikeFilter) Apply(samples []Sample) []Sample {
+	result := make([]Sample, len(samples))
+	copy(result, samples)
+	good := consistent(samples, func(s0, s1 *Sample) bool {
+		rate := climbRate(s0, s1)
+		return -f.MaxClimbRate <= rate && rate <= f.MaxClimbRate
+	})
+	if len(good) == 0 {
+		return result
+	}
+	for j := 0; j < good[0]; j++ {
+		result[j].Coords.Altitude = samples[good[0]].Coords.Altitude
+	}
+	for k := 1; k < len(good); k++ {
+		g0, g1 := &samples[good[k-1]], &samples[good[k]]
+		for j := good[k-1] + 1; j < good[k]; j++ {
+			g := float64(result[j].Time-g0.Time) / float64(g1.Time-g0.Time)
+			result[j].Coords.Altitude = g0.Coords.Altitude + g*(g1.Coords.Altitude-g0.Coords.Altitude)
+		}
+	}
+	last := good[len(good)-1]
+	for j := last + 1; j < len(result); j++ {
+		result[j].Coords.Altitude = samples[last].Coords.Altitude
+	}
+	return result
+}
@@ -0,0 +1,156 @@
+package doarama_test
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/twpayne/go-doarama"
+)
+
+func TestFilters(t *testing.T) {
+	t0 := time.Date(2015, 7, 5, 9, 30, 0, 0, time.UTC)
+	at := func(seconds int) time.Time {
+		return t0.Add(time.Duration(seconds) * time.Second)
+	}
+	for _, tc := range []struct {
+		name    string
+		filter  doarama.Filter
+		samples []doarama.Sample
+		want    []doarama.Sample
+	}{
+		{
+			name:   "speed_gate",
+			filter: &doarama.SpeedGate{MaxSpeed: 50},
+			samples: []doarama.Sample{
+				newSample(at(0), 47, 13, 500),
+				newSample(at(1), 47.0001, 13, 500),
+				newSample(at(2), 48, 13, 500),
+				newSample(at(3), 47.0002, 13, 500),
+			},
+			want: []doarama.Sample{
+				newSample(at(0), 47, 13, 500),
+				newSample(at(1), 47.0001, 13, 500),
+				newSample(at(3), 47.0002, 13, 500),
+			},
+		},
+		{
+			name:   "speed_gate_bad_first_sample",
+			filter: &doarama.SpeedGate{MaxSpeed: 50},
+			samples: []doarama.Sample{
+				newSample(at(0), 48, 13, 500),
+				newSample(at(1), 47, 13, 500),
+				newSample(at(2), 47.0001, 13, 500),
+				newSample(at(3), 47.0002, 13, 500),
+				newSample(at(4), 47.0003, 13, 500),
+			},
+			want: []doarama.Sample{
+				newSample(at(1), 47, 13, 500),
+				newSample(at(2), 47.0001, 13, 500),
+				newSample(at(3), 47.0002, 13, 500),
+				newSample(at(4), 47.0003, 13, 500),
+			},
+		},
+		{
+			name:   "speed_gate_short_run",
+			filter: &doarama.SpeedGate{MaxSpeed: 50},
+			samples: []doarama.Sample{
+				newSample(at(0), 47, 13, 500),
+				newSample(at(1), 47.0001, 13, 500),
+				newSample(at(2), 47.0002, 13, 500),
+				newSample(at(3), 48, 13, 500),
+				newSample(at(4), 48.0001, 13, 500),
+				newSample(at(5), 48.0002, 13, 500),
+			},
+			want: []doarama.Sample{
+				newSample(at(0), 47, 13, 500),
+				newSample(at(1), 47.0001, 13, 500),
+				newSample(at(2), 47.0002, 13, 500),
+			},
+		},
+		{
+			name:   "moving_average",
+			filter: &doarama.MovingAverage{Window: 3},
+			samples: []doarama.Sample{
+				newSample(at(0), 47, 13, 500),
+				newSample(at(1), 47, 13, 530),
+				newSample(at(2), 47, 13, 500),
+			},
+			want: []doarama.Sample{
+				newSample(at(0), 47, 13, 515),
+				newSample(at(1), 47, 13, 510),
+				newSample(at(2), 47, 13, 515),
+			},
+		},
+		{
+			name:   "moving_average_even_window",
+			filter: &doarama.MovingAverage{Window: 2},
+			samples: []doarama.Sample{
+				newSample(at(0), 47, 13, 500),
+				newSample(at(1), 47, 13, 530),
+				newSample(at(2), 47, 13, 500),
+			},
+			want: []doarama.Sample{
+				newSample(at(0), 47, 13, 500),
+				newSample(at(1), 47, 13, 515),
+				newSample(at(2), 47, 13, 515),
+			},
+		},
+		{
+			name:   "altitude_spike",
+			filter: &doarama.AltitudeSpikeFilter{MaxClimbRate: 20},
+			samples: []doarama.Sample{
+				newSample(at(0), 47, 13, 500),
+				newSample(at(1), 47, 13, 9999),
+				newSample(at(2), 47, 13, 0),
+				newSample(at(3), 47, 13, 530),
+			},
+			want: []doarama.Sample{
+				newSample(at(0), 47, 13, 500),
+				newSample(at(1), 47, 13, 510),
+				newSample(at(2), 47, 13, 520),
+				newSample(at(3), 47, 13, 530),
+			},
+		},
+		{
+			name:   "altitude_spike_bad_first_sample",
+			filter: &doarama.AltitudeSpikeFilter{MaxClimbRate: 20},
+			samples: []doarama.Sample{
+				newSample(at(0), 47, 13, 9999),
+				newSample(at(1), 47, 13, 500),
+				newSample(at(2), 47, 13, 510),
+				newSample(at(3), 47, 13, 520),
+				newSample(at(4), 47, 13, 530),
+			},
+			want: []doarama.Sample{
+				newSample(at(0), 47, 13, 500),
+				newSample(at(1), 47, 13, 500),
+				newSample(at(2), 47, 13, 510),
+				newSample(at(3), 47, 13, 520),
+				newSample(at(4), 47, 13, 530),
+			},
+		},
+		{
+			name: "pipeline",
+			filter: doarama.Pipeline{
+				doarama.FilterFunc(func(samples []doarama.Sample) []doarama.Sample {
+					return doarama.Shift(samples, time.Second)
+				}),
+				&doarama.SpeedGate{MaxSpeed: 50},
+			},
+			samples: []doarama.Sample{
+				newSample(at(0), 47, 13, 500),
+				newSample(at(1), 48, 13, 500),
+			},
+			want: []doarama.Sample{
+				newSample(at(1), 47, 13, 500),
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := tc.filter.Apply(tc.samples); !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("%#v.Apply(%#v) == %#v, want %#v", tc.filter, tc.samples, got, tc.want)
+			}
+		})
+	}
+}
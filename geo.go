@@ -0,0 +1,20 @@
+package doarama
+
+import "math"
+
+// earthRadius is the mean radius of the Earth in meters.
+const earthRadius = 6371009
+
+// toRadians converts degrees to radians.
+func toRadians(deg float64) float64 {
+	return deg * math.Pi / 180
+}
+
+// distance returns the great circle distance in meters between two points.
+func distance(lat1, lng1, lat2, lng2 float64) float64 {
+	phi1, phi2 := toRadians(lat1), toRadians(lat2)
+	dPhi := phi2 - phi1
+	dLambda := toRadians(lng2 - lng1)
+	a := math.Sin(dPhi/2)*math.Sin(dPhi/2) + math.Cos(phi1)*math.Cos(phi2)*math.Sin(dLambda/2)*math.Sin(dLambda/2)
+	return 2 * earthRadius * math.Asin(math.Min(1, math.Sqrt(a)))
+}
@@ -0,0 +1,109 @@
+package doarama
+
+import "time"
+
+// Default group options.
+const (
+	DefaultGroupMinOverlap  = 10 * time.Minute
+	DefaultGroupMaxDistance = 50000
+)
+
+// A GroupOptions specifies how tracks are grouped.
+type GroupOptions struct {
+	// MinOverlap is the minimum time that two tracks must overlap for them
+	// to be in the same group. Zero means DefaultGroupMinOverlap.
+	MinOverlap time.Duration
+	// MaxDistance is the distance in meters that two tracks must come
+	// within of each other, at the same time, for them to be in the same
+	// group. Zero means DefaultGroupMaxDistance.
+	MaxDistance float64
+}
+
+// near returns whether a and b overlap by at least minOverlap and are within
+// maxDistance of each other at some time during their overlap. a and b must
+// be sorted and non-empty.
+func near(a, b []Sample, minOverlap Timestamp, maxDistance float64) bool {
+	start, end := a[0].Time, a[len(a)-1].Time
+	if b[0].Time > start {
+		start = b[0].Time
+	}
+	if b[len(b)-1].Time < end {
+		end = b[len(b)-1].Time
+	}
+	if end-start < minOverlap {
+		return false
+	}
+	stride := len(a)/maxAlignSamples + 1
+	maxGap := durationToTimestamp(DefaultMergeMaxGap)
+	for i := 0; i < len(a); i += stride {
+		s := a[i]
+		if s.Time < start || s.Time > end {
+			continue
+		}
+		lat, lng, ok := interpolatePosition(b, s.Time, maxGap)
+		if ok && distance(s.Coords.Latitude, s.Coords.Longitude, lat, lng) <= maxDistance {
+			return true
+		}
+	}
+	return false
+}
+
+// GroupByOverlap clusters tracks that were recorded at the same time and
+// place, such as the tracks of pilots flying the same competition task. Two
+// tracks are in the same group if they overlap in time by at least
+// options.MinOverlap and come within options.MaxDistance of each other during
+// that overlap, or if they are both in the same group as a third track. It
+// returns the indexes of the tracks in each group, ordered by their first
+// index. Empty tracks are in groups of their own. If options is nil then
+// default options are used.
+func GroupByOverlap(tracks [][]Sample, options *GroupOptions) [][]int {
+	if options == nil {
+		options = &GroupOptions{}
+	}
+	minOverlap := durationToTimestamp(options.MinOverlap)
+	if options.MinOverlap == 0 {
+		minOverlap = durationToTimestamp(DefaultGroupMinOverlap)
+	}
+	maxDistance := options.MaxDistance
+	if maxDistance == 0 {
+		maxDistance = DefaultGroupMaxDistance
+	}
+	sorted := make([][]Sample, len(tracks))
+	for i, track := range tracks {
+		sorted[i] = sortAndDedup(track, 0)
+	}
+	parent := make([]int, len(tracks))
+	for i := range parent {
+		parent[i] = i
+	}
+	var find func(int) int
+	find = func(i int) int {
+		if parent[i] != i {
+			parent[i] = find(parent[i])
+		}
+		return parent[i]
+	}
+	for i := range sorted {
+		for j := i + 1; j < len(sorted); j++ {
+			if len(sorted[i]) == 0 || len(sorted[j]) == 0 || find(i) == find(j) {
+				continue
+			}
+			if near(sorted[i], sorted[j], minOverlap, maxDistance) || near(sorted[j], sorted[i], minOverlap, maxDistance) {
+				parent[find(j)] = find(i)
+			}
+		}
+	}
+	var groups [][]int
+	index := make(map[int]int)
+	for i := range tracks {
+		root := find(i)
+		g, ok := index[root]
+		if !ok {
+			g = len(groups)
+			index[root] = g
+			groups = append(groups, nil)
+		}
+		groups[g] = append(groups[g], i)
+	}
+	return groups
+}
@@ -0,0 +1,101 @@
+package doarama_test
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/twpayne/go-doarama"
+)
+
+func TestGroupByOverlap(t *testing.T) {
+	t0 := time.Date(2015, 7, 5, 9, 30, 0, 0, time.UTC)
+	// track returns a track with a sample every five seconds from minute
+	// start to minute end, moving east from lat, lng.
+	track := func(start, end int, lat, lng float64) []doarama.Sample {
+		var samples []doarama.Sample
+		for s := 60 * start; s <= 60*end; s += 5 {
+			samples = append(samples, newSample(t0.Add(time.Duration(s)*time.Second), lat, lng+float64(s)/36000, 1000))
+		}
+		return samples
+	}
+	for _, tc := range []struct {
+		name    string
+		tracks  [][]doarama.Sample
+		options *doarama.GroupOptions
+		want    [][]int
+	}{
+		{
+			name: "empty",
+		},
+		{
+			name: "single",
+			tracks: [][]doarama.Sample{
+				track(0, 60, 46, 6),
+			},
+			want: [][]int{{0}},
+		},
+		{
+			name: "overlap",
+			tracks: [][]doarama.Sample{
+				track(0, 60, 46, 6),
+				track(30, 90, 46.1, 6),
+			},
+			want: [][]int{{0, 1}},
+		},
+		{
+			name: "short_overlap",
+			tracks: [][]doarama.Sample{
+				track(0, 60, 46, 6),
+				track(55, 90, 46, 6),
+			},
+			want: [][]int{{0}, {1}},
+		},
+		{
+			name: "far_apart",
+			tracks: [][]doarama.Sample{
+				track(0, 60, 46, 6),
+				track(0, 60, 47, 6),
+			},
+			want: [][]int{{0}, {1}},
+		},
+		{
+			name: "options",
+			tracks: [][]doarama.Sample{
+				track(0, 60, 46, 6),
+				track(0, 60, 47, 6),
+			},
+			options: &doarama.GroupOptions{
+				MaxDistance: 200000,
+			},
+			want: [][]int{{0, 1}},
+		},
+		{
+			name: "transitive",
+			tracks: [][]doarama.Sample{
+				track(0, 60, 46, 6),
+				track(120, 180, 46, 6),
+				track(30, 150, 46, 6),
+				{},
+			},
+			want: [][]int{{0, 1, 2}, {3}},
+		},
+		{
+			name: "competition_day",
+			tracks: [][]doarama.Sample{
+				track(0, 120, 46, 6),
+				track(0, 120, 44, 7),
+				track(10, 100, 46.2, 6.1),
+				track(240, 300, 46, 6),
+				track(5, 110, 44.1, 7),
+			},
+			want: [][]int{{0, 2}, {1, 4}, {3}},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := doarama.GroupByOverlap(tc.tracks, tc.options); !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("doarama.GroupByOverlap(..., %+v) == %v, want %v", tc.options, got, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,190 @@
+package doarama
+
+import (
+	"sort"
+	"time"
+)
+
+// Default merge options.
+const (
+	DefaultMergeTolerance = time.Second
+	DefaultMergeMaxGap    = 10 * time.Second
+)
+
+// A MergeOptions specifies how tracks are merged.
+type MergeOptions struct {
+	// Tolerance is the maximum time difference between two samples for them
+	// to be considered duplicates. Zero means DefaultMergeTolerance.
+	Tolerance time.Duration
+	// MaxGap is the longest interval between two samples that is not filled
+	// from secondary tracks. Zero means DefaultMergeMaxGap.
+	MaxGap time.Duration
+	// AltitudeSource is the index of the track that altitudes are taken
+	// from. nil means that the track with the best altitudes is chosen
+	// automatically.
+	AltitudeSource *int
+}
+
+// durationToTimestamp converts d to a Timestamp interval.
+func durationToTimestamp(d time.Duration) Timestamp {
+	return Timestamp(d / time.Millisecond)
+}
+
+// sortAndDedup returns a sorted copy of samples with samples within tolerance
+// of their predecessor removed.
+func sortAndDedup(samples []Sample, tolerance Timestamp) []Sample {
+	sorted := make([]Sample, len(samples))
+	copy(sorted, samples)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Time < sorted[j].Time
+	})
+	var result []Sample
+	for _, s := range sorted {
+		if len(result) > 0 && s.Time-result[len(result)-1].Time <= tolerance {
+			continue
+		}
+		result = append(result, s)
+	}
+	return result
+}
+
+// fillGaps returns primary with samples from secondary inserted wherever
+// primary has a gap longer than maxGap. Both must be sorted.
+func fillGaps(primary, secondary []Sample, tolerance, maxGap Timestamp) []Sample {
+	result := make([]Sample, 0, len(primary))
+	i := 0
+	for _, s := range secondary {
+		for i < len(primary) && primary[i].Time <= s.Time {
+			result = append(result, primary[i])
+			i++
+		}
+		hasPrev := i > 0
+		hasNext := i < len(primary)
+		if hasPrev && hasNext && primary[i].Time-primary[i-1].Time <= maxGap {
+			continue
+		}
+		if hasPrev && s.Time-primary[i-1].Time <= tolerance {
+			continue
+		}
+		if hasNext && primary[i].Time-s.Time <= tolerance {
+			continue
+		}
+		if n := len(result); n > 0 && s.Time-result[n-1].Time <= tolerance {
+			continue
+		}
+		result = append(result, s)
+	}
+	return append(result, primary[i:]...)
+}
+
+// altitudeQuality returns the fraction of samples with a non-zero altitude
+// and the mean altitude accuracy, or zero if no accuracies are known.
+func altitudeQuality(samples []Sample) (float64, float64) {
+	if len(samples) == 0 {
+		return 0, 0
+	}
+	valid, accuracies := 0, 0
+	sumAccuracy := 0.0
+	for _, s := range samples {
+		if s.Coords.Altitude != 0 {
+			valid++
+		}
+		if s.Coords.AltitudeAccuracy > 0 {
+			accuracies++
+			sumAccuracy += s.Coords.AltitudeAccuracy
+		}
+	}
+	meanAccuracy := 0.0
+	if accuracies > 0 {
+		meanAccuracy = sumAccuracy / float64(accuracies)
+	}
+	return float64(valid) / float64(len(samples)), meanAccuracy
+}
+
+// bestAltitudeSource returns the index of the track with the best altitudes.
+// Tracks with more valid altitudes are preferred, then tracks with better
+// altitude accuracy, then earlier tracks.
+func bestAltitudeSource(tracks [][]Sample) int {
+	best := 0
+	bestValid, bestAccuracy := altitudeQuality(tracks[0])
+	for i, track := range tracks[1:] {
+		valid, accuracy := altitudeQuality(track)
+		switch {
+		case valid > bestValid:
+		case valid == bestValid && accuracy != 0 && (bestAccuracy == 0 || accuracy < bestAccuracy):
+		default:
+			continue
+		}
+		best, bestValid, bestAccuracy = i+1, valid, accuracy
+	}
+	return best
+}
+
+// interpolateAltitude returns the altitude of samples at t, interpolating
+// between samples no more than maxGap apart. samples must be sorted.
+func interpolateAltitude(samples []Sample, t, tolerance, maxGap Timestamp) (float64, bool) {
+	i := sort.Search(len(samples), func(i int) bool {
+		return samples[i].Time >= t
+	})
+	if i < len(samples) && samples[i].Time-t <= tolerance {
+		return samples[i].Coords.Altitude, true
+	}
+	if i > 0 && t-samples[i-1].Time <= tolerance {
+		return samples[i-1].Coords.Altitude, true
+	}
+	if i == 0 || i == len(samples) {
+		return 0, false
+	}
+	s0, s1 := samples[i-1], samples[i]
+	if s1.Time-s0.Time > maxGap {
+		return 0, false
+	}
+	f := float64(t-s0.Time) / float64(s1.Time-s0.Time)
+	return s0.Coords.Altitude + f*(s1.Coords.Altitude-s0.Coords.Altitude), true
+}
+
+// Merge merges multiple tracks of the same activity, for example from two
+// loggers carried by the same pilot. tracks are in decreasing order of
+// priority: the first track is used wherever it has samples, and gaps in it
+// are filled from subsequent tracks. Samples within options.Tolerance of each
+// other are considered duplicates. Altitudes are taken from the track
+// selected by options.AltitudeSource where available. If options is nil then
+// default options are used.
+func Merge(tracks [][]Sample, options *MergeOptions) []Sample {
+	if options == nil {
+		options = &MergeOptions{}
+	}
+	tolerance := durationToTimestamp(options.Tolerance)
+	if options.Tolerance == 0 {
+		tolerance = durationToTimestamp(DefaultMergeTolerance)
+	}
+	maxGap := durationToTimestamp(options.MaxGap)
+	if options.MaxGap == 0 {
+		maxGap = durationToTimestamp(DefaultMergeMaxGap)
+	}
+	if len(tracks) == 0 {
+		return nil
+	}
+	sorted := make([][]Sample, len(tracks))
+	for i, track := range tracks {
+		sorted[i] = sortAndDedup(track, tolerance)
+	}
+	merged := sorted[0]
+	for _, track := range sorted[1:] {
+		merged = fillGaps(merged, track, tolerance, maxGap)
+	}
+	var altitudeSource int
+	if options.AltitudeSource != nil {
+		altitudeSource = *options.AltitudeSource
+	} else {
+		altitudeSource = bestAltitudeSource(sorted)
+	}
+	if 0 <= altitudeSource && altitudeSource < len(sorted) {
+		for i := range merged {
+			if altitude, ok := interpolateAltitude(sorted[altitudeSource], merged[i].Time, tolerance, maxGap); ok {
+				merged[i].Coords.Altitude = altitude
+			}
+		}
+	}
+	return merged
+}
@@ -0,0 +1,147 @@
+package doarama_test
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/twpayne/go-doarama"
+)
+
+func newSample(t time.Time, lat, lng, alt float64) doarama.Sample {
+	return doarama.Sample{
+		Time: doarama.NewTimestamp(t),
+		Coords: doarama.Coords{
+			Latitude:  lat,
+			Longitude: lng,
+			Altitude:  alt,
+		},
+	}
+}
+
+func TestMerge(t *testing.T) {
+	t0 := time.Date(2015, 7, 5, 9, 30, 0, 0, time.UTC)
+	at := func(seconds int) time.Time {
+		return t0.Add(time.Duration(seconds) * time.Second)
+	}
+	for _, tc := range []struct {
+		name    string
+		tracks  [][]doarama.Sample
+		options *doarama.MergeOptions
+		want    []doarama.Sample
+	}{
+		{
+			name: "empty",
+		},
+		{
+			name: "dedup",
+			tracks: [][]doarama.Sample{
+				{
+					newSample(at(2), 47, 13, 500),
+					newSample(at(0), 47, 13, 500),
+					newSample(at(0), 47, 13, 501),
+				},
+			},
+			options: &doarama.MergeOptions{},
+			want: []doarama.Sample{
+				newSample(at(0), 47, 13, 500),
+				newSample(at(2), 47, 13, 500),
+			},
+		},
+		{
+			name: "fill_gaps",
+			tracks: [][]doarama.Sample{
+				{
+					newSample(at(0), 47, 13, 500),
+					newSample(at(60), 47.1, 13, 600),
+					newSample(at(62), 47.1, 13, 600),
+				},
+				{
+					newSample(at(-2), 47, 13, 0),
+					newSample(at(0), 47, 13, 0),
+					newSample(at(20), 47.03, 13, 0),
+					newSample(at(40), 47.06, 13, 0),
+					newSample(at(61), 47.1, 13, 0),
+					newSample(at(80), 47.2, 13, 0),
+				},
+			},
+			options: &doarama.MergeOptions{
+				MaxGap: 30 * time.Second,
+			},
+			want: []doarama.Sample{
+				newSample(at(-2), 47, 13, 0),
+				newSample(at(0), 47, 13, 500),
+				newSample(at(20), 47.03, 13, 0),
+				newSample(at(40), 47.06, 13, 0),
+				newSample(at(60), 47.1, 13, 600),
+				newSample(at(62), 47.1, 13, 600),
+				newSample(at(80), 47.2, 13, 0),
+			},
+		},
+		{
+			name: "auto_altitude_source",
+			tracks: [][]doarama.Sample{
+				{
+					newSample(at(0), 47, 13, 0),
+					newSample(at(2), 47, 13, 0),
+					newSample(at(4), 47, 13, 0),
+				},
+				{
+					newSample(at(0), 47.5, 13.5, 500),
+					newSample(at(4), 47.5, 13.5, 540),
+				},
+			},
+			want: []doarama.Sample{
+				newSample(at(0), 47, 13, 500),
+				newSample(at(2), 47, 13, 520),
+				newSample(at(4), 47, 13, 540),
+			},
+		},
+		{
+			name: "auto_altitude_source_with_options",
+			tracks: [][]doarama.Sample{
+				{
+					newSample(at(0), 47, 13, 0),
+					newSample(at(2), 47, 13, 0),
+				},
+				{
+					newSample(at(0), 47.5, 13.5, 500),
+					newSample(at(2), 47.5, 13.5, 520),
+				},
+			},
+			options: &doarama.MergeOptions{
+				Tolerance: time.Second,
+			},
+			want: []doarama.Sample{
+				newSample(at(0), 47, 13, 500),
+				newSample(at(2), 47, 13, 520),
+			},
+		},
+		{
+			name: "fixed_altitude_source",
+			tracks: [][]doarama.Sample{
+				{
+					newSample(at(0), 47, 13, 0),
+					newSample(at(2), 47, 13, 0),
+				},
+				{
+					newSample(at(0), 47.5, 13.5, 500),
+					newSample(at(2), 47.5, 13.5, 520),
+				},
+			},
+			options: &doarama.MergeOptions{
+				AltitudeSource: new(int),
+			},
+			want: []doarama.Sample{
+				newSample(at(0), 47, 13, 0),
+				newSample(at(2), 47, 13, 0),
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := doarama.Merge(tc.tracks, tc.options); !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("doarama.Merge(%#v, %#v) == %#v, want %#v", tc.tracks, tc.options, got, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,305 @@
+package doarama
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxRandomPointAttempts is the maximum number of random points tried when
+// jittering a sample in a polygon zone. Thin polygons fill little of their
+// bounding box, so most random points in it miss them.
+const maxRandomPointAttempts = 1000
+
+// An ErrPrivacyUnsupported is returned when a privacy filter cannot be applied
+// to a GPS track because its format is not supported.
+type ErrPrivacyUnsupported struct {
+	Filename string
+}
+
+// Error implements error.
+func (e *ErrPrivacyUnsupported) Error() string {
+	return fmt.Sprintf("%s: privacy zones can only be applied to GPX and IGC tracks", e.Filename)
+}
+
+// A Point is a point on the Earth's surface.
+type Point struct {
+	Latitude  float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
+}
+
+// A PrivacyZone is an area in which samples are hidden. A zone is either a
+// circle, with a center and a radius in meters, or a polygon. Decoy, if set,
+// is the point within the zone that jittered samples are moved to.
+type PrivacyZone struct {
+	Name      string  `json:"name,omitempty"`
+	Latitude  float64 `json:"latitude,omitempty"`
+	Longitude float64 `json:"longitude,omitempty"`
+	Radius    float64 `json:"radius,omitempty"`
+	Polygon   []Point `json:"polygon,omitempty"`
+	Decoy     *Point  `json:"decoy,omitempty"`
+}
+
+// A PrivacyFilter removes or jitters samples within privacy zones. Zones must
+// not be changed once the filter has been applied.
+type PrivacyFilter struct {
+	Zones []PrivacyZone
+	// Jitter, if true, moves every sample in a zone to the zone's decoy
+	// instead of removing it. Zones without a decoy get a random point in
+	// the zone, chosen once per filter, so that jittered samples do not
+	// outline the zone or reveal its center. Random points in different
+	// filters still average to the zone's center, so set a decoy to hide the
+	// center of a circle that is used often. Samples in polygons too thin to
+	// find a random point in are removed.
+	Jitter bool
+	// Rand is the source of randomness for choosing decoys. If nil, a source
+	// seeded from the current time is used.
+	Rand *rand.Rand
+
+	once   sync.Once
+	decoys []*Point
+}
+
+// Validate returns an error if z is not a valid privacy zone.
+func (z *PrivacyZone) Validate() error {
+	switch {
+	case z.Radius < 0:
+		return fmt.Errorf("privacy zone %q: negative radius", z.Name)
+	case z.Radius > 0 && z.Polygon != nil:
+		return fmt.Errorf("privacy zone %q: both radius and polygon specified", z.Name)
+	case z.Radius == 0 && len(z.Polygon) < 3:
+		return fmt.Errorf("privacy zone %q: radius or polygon with at least three points required", z.Name)
+	case z.Decoy != nil && !z.Contains(z.Decoy.Latitude, z.Decoy.Longitude):
+		return fmt.Errorf("privacy zone %q: decoy outside zone", z.Name)
+	default:
+		return nil
+	}
+}
+
+// Contains returns true if z contains the point at lat, lng.
+func (z *PrivacyZone) Contains(lat, lng float64) bool {
+	if z.Polygon == nil {
+		return distance(z.Latitude, z.Longitude, lat, lng) <= z.Radius
+	}
+	inside := false
+	for i, j := 0, len(z.Polygon)-1; i < len(z.Polygon); j, i = i, i+1 {
+		pi, pj := z.Polygon[i], z.Polygon[j]
+		if (pi.Latitude > lat) != (pj.Latitude > lat) &&
+			lng < (pj.Longitude-pi.Longitude)*(lat-pi.Latitude)/(pj.Latitude-pi.Latitude)+pi.Longitude {
+			inside = !inside
+		}
+	}
+	return inside
+}
+
+// randomPoint returns a random point uniformly distributed within z. It
+// returns false if it does not find a point in a polygon zone within
+// maxRandomPointAttempts attempts.
+func (z *PrivacyZone) randomPoint(r *rand.Rand) (float64, float64, bool) {
+	if z.Polygon == nil {
+		d := z.Radius * math.Sqrt(r.Float64())
+		theta := 2 * math.Pi * r.Float64()
+		dLat := d * math.Cos(theta) / earthRadius * 180 / math.Pi
+		dLng := d * math.Sin(theta) / (earthRadius * math.Cos(toRadians(z.Latitude))) * 180 / math.Pi
+		return z.Latitude + dLat, z.Longitude + dLng, true
+	}
+	minLat, maxLat := z.Polygon[0].Latitude, z.Polygon[0].Latitude
+	minLng, maxLng := z.Polygon[0].Longitude, z.Polygon[0].Longitude
+	for _, p := range z.Polygon[1:] {
+		minLat, maxLat = math.Min(minLat, p.Latitude), math.Max(maxLat, p.Latitude)
+		minLng, maxLng = math.Min(minLng, p.Longitude), math.Max(maxLng, p.Longitude)
+	}
+	for i := 0; i < maxRandomPointAttempts; i++ {
+		lat := minLat + r.Float64()*(maxLat-minLat)
+		lng := minLng + r.Float64()*(maxLng-minLng)
+		if z.Contains(lat, lng) {
+			return lat, lng, true
+		}
+	}
+	return 0, 0, false
+}
+
+// active returns whether f hides any samples.
+func (f *PrivacyFilter) active() bool {
+	return f != nil && len(f.Zones) > 0
+}
+
+// rand returns f's source of randomness.
+func (f *PrivacyFilter) rand() *rand.Rand {
+	if f.Rand != nil {
+		return f.Rand
+	}
+	return rand.New(rand.NewSource(time.Now().UnixNano()))
+}
+
+// zone returns the index of the first zone containing lat, lng, or -1.
+func (f *PrivacyFilter) zone(lat, lng float64) int {
+	for i := range f.Zones {
+		if f.Zones[i].Contains(lat, lng) {
+			return i
+		}
+	}
+	return -1
+}
+
+// decoy returns the point that samples in the zone with index i are moved to,
+// or nil if there is none.
+func (f *PrivacyFilter) decoy(i int) *Point {
+	f.once.Do(func() {
+		r := f.rand()
+		f.decoys = make([]*Point, len(f.Zones))
+		for i := range f.Zones {
+			z := &f.Zones[i]
+			if z.Decoy != nil {
+				f.decoys[i] = z.Decoy
+			} else if lat, lng, ok := z.randomPoint(r); ok {
+				f.decoys[i] = &Point{Latitude: lat, Longitude: lng}
+			}
+		}
+	})
+	return f.decoys[i]
+}
+
+// filter returns the position lat, lng with f applied, and false if it is
+// removed. Positions that cannot be jittered are removed.
+func (f *PrivacyFilter) filter(lat, lng float64) (float64, float64, bool) {
+	i := f.zone(lat, lng)
+	if i < 0 {
+		return lat, lng, true
+	}
+	if !f.Jitter {
+		return 0, 0, false
+	}
+	p := f.decoy(i)
+	if p == nil {
+		return 0, 0, false
+	}
+	return p.Latitude, p.Longitude, true
+}
+
+// Apply returns samples with the samples within f's zones removed or
+// jittered. samples is not modified.
+func (f *PrivacyFilter) Apply(samples []Sample) []Sample {
+	if !f.active() {
+		return samples
+	}
+	result := make([]Sample, 0, len(samples))
+	for _, s := range samples {
+		lat, lng, ok := f.filter(s.Coords.Latitude, s.Coords.Longitude)
+		if !ok {
+			continue
+		}
+		s.Coords.Latitude, s.Coords.Longitude = lat, lng
+		result = append(result, s)
+	}
+	return result
+}
+
+// supports returns an error if f cannot be applied to a GPS track in
+// filename's format.
+func (f *PrivacyFilter) supports(filename string) error {
+	if !f.active() {
+		return nil
+	}
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".gpx", ".igc":
+		return nil
+	default:
+		return &ErrPrivacyUnsupported{Filename: filename}
+	}
+}
+
+// applyTrack writes gpsTrack, whose format is determined from filename, to w
+// with f applied. IGC tracks are filtered record by record, see applyIGC, and
+// GPX tracks are rewritten with WriteGPX.
+func (f *PrivacyFilter) applyTrack(filename string, w io.Writer, gpsTrack io.Reader) error {
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".gpx":
+		samples, err := ReadGPX(gpsTrack)
+		if err != nil {
+			return err
+		}
+		return WriteGPX(w, f.Apply(samples))
+	case ".igc":
+		return f.applyIGC(w, gpsTrack)
+	default:
+		return &ErrPrivacyUnsupported{Filename: filename}
+	}
+}
+
+// applyIGC copies the IGC file r to w with f applied to the positions in its
+// B (fix) and C (task) records. Records in zones are removed or have their
+// positions replaced. All other records, including the headers, are copied
+// unchanged, although the G record's security signature will no longer
+// verify.
+func (f *PrivacyFilter) applyIGC(w io.Writer, r io.Reader) error {
+	bw := bufio.NewWriter(w)
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		offset := -1
+		switch {
+		case strings.HasPrefix(line, "B") && len(line) >= 24:
+			offset = 7
+		case strings.HasPrefix(line, "C") && len(line) >= 18:
+			offset = 1
+		}
+		if offset >= 0 {
+			lat, err1 := parseIGCAngle(line[offset:offset+8], 2, "NS")
+			lng, err2 := parseIGCAngle(line[offset+8:offset+17], 3, "EW")
+			if err1 == nil && err2 == nil {
+				lat, lng, ok := f.filter(lat, lng)
+				if !ok {
+					continue
+				}
+				line = line[:offset] + formatIGCPosition(lat, lng) + line[offset+17:]
+			}
+		}
+		if _, err := bw.WriteString(line + "\r\n"); err != nil {
+			return err
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// applyPtrs is like Apply but for a slice of pointers to samples.
+func (f *PrivacyFilter) applyPtrs(samples []*Sample) []*Sample {
+	values := make([]Sample, len(samples))
+	for i, s := range samples {
+		values[i] = *s
+	}
+	values = f.Apply(values)
+	result := make([]*Sample, len(values))
+	for i := range values {
+		result[i] = &values[i]
+	}
+	return result
+}
+
+// ReadPrivacyZones reads privacy zones in JSON format from r.
+func ReadPrivacyZones(r io.Reader) ([]PrivacyZone, error) {
+	var zones []PrivacyZone
+	if err := json.NewDecoder(r).Decode(&zones); err != nil {
+		return nil, err
+	}
+	if len(zones) == 0 {
+		return nil, errors.New("no privacy zones")
+	}
+	for i := range zones {
+		if err := zones[i].Validate(); err != nil {
+			return nil, err
+		}
+	}
+	return zones, nil
+}
@@ -0,0 +1,145 @@
+package doarama_test
+
+import (
+	"math/rand"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/twpayne/go-doarama"
+)
+
+func TestPrivacyZoneContains(t *testing.T) {
+	for _, tc := range []struct {
+		z    doarama.PrivacyZone
+		lat  float64
+		lng  float64
+		want bool
+	}{
+		{
+			z:    doarama.PrivacyZone{Latitude: 47, Longitude: 13, Radius: 1000},
+			lat:  47.005,
+			lng:  13,
+			want: true,
+		},
+		{
+			z:    doarama.PrivacyZone{Latitude: 47, Longitude: 13, Radius: 1000},
+			lat:  47.01,
+			lng:  13,
+			want: false,
+		},
+		{
+			z: doarama.PrivacyZone{
+				Polygon: []doarama.Point{
+					{Latitude: 0, Longitude: 0},
+					{Latitude: 0, Longitude: 1},
+					{Latitude: 1, Longitude: 1},
+					{Latitude: 1, Longitude: 0},
+				},
+			},
+			lat:  0.5,
+			lng:  0.5,
+			want: true,
+		},
+		{
+			z: doarama.PrivacyZone{
+				Polygon: []doarama.Point{
+					{Latitude: 0, Longitude: 0},
+					{Latitude: 0, Longitude: 1},
+					{Latitude: 1, Longitude: 1},
+				},
+			},
+			lat:  0.75,
+			lng:  0.25,
+			want: false,
+		},
+	} {
+		if got := tc.z.Contains(tc.lat, tc.lng); got != tc.want {
+			t.Errorf("%#v.Contains(%v, %v) == %v, want %v", tc.z, tc.lat, tc.lng, got, tc.want)
+		}
+	}
+}
+
+func TestPrivacyFilter(t *testing.T) {
+	t0 := time.Date(2015, 7, 5, 9, 30, 0, 0, time.UTC)
+	samples := []doarama.Sample{
+		newSample(t0, 47, 13, 500),
+		newSample(t0.Add(time.Second), 47.001, 13, 500),
+		newSample(t0.Add(2*time.Second), 47.1, 13, 500),
+	}
+	zone := doarama.PrivacyZone{Latitude: 47, Longitude: 13, Radius: 1000}
+	f := &doarama.PrivacyFilter{
+		Zones: []doarama.PrivacyZone{zone},
+	}
+	if got, want := f.Apply(samples), samples[2:]; !reflect.DeepEqual(got, want) {
+		t.Errorf("f.Apply(%#v) == %#v, want %#v", samples, got, want)
+	}
+
+	f = &doarama.PrivacyFilter{
+		Zones:  []doarama.PrivacyZone{zone},
+		Jitter: true,
+		Rand:   rand.New(rand.NewSource(1)),
+	}
+	got := f.Apply(samples)
+	if len(got) != 3 || !reflect.DeepEqual(got[2], samples[2]) {
+		t.Fatalf("f.Apply(%#v) == %#v, want three samples with the third unchanged", samples, got)
+	}
+	if got[0].Coords == samples[0].Coords || !zone.Contains(got[0].Coords.Latitude, got[0].Coords.Longitude) {
+		t.Errorf("f.Apply(%#v)[0].Coords == %#v, want a random decoy within zone", samples, got[0].Coords)
+	}
+	if got[1].Coords != got[0].Coords {
+		t.Errorf("f.Apply(%#v)[1].Coords == %#v, want the same decoy %#v", samples, got[1].Coords, got[0].Coords)
+	}
+	if again := f.Apply(samples); again[0].Coords != got[0].Coords {
+		t.Errorf("f.Apply(%#v)[0].Coords == %#v the second time, want the same decoy %#v", samples, again[0].Coords, got[0].Coords)
+	}
+
+	decoy := doarama.Point{Latitude: 47.005, Longitude: 13.002}
+	decoyZone := zone
+	decoyZone.Decoy = &decoy
+	f = &doarama.PrivacyFilter{
+		Zones:  []doarama.PrivacyZone{decoyZone},
+		Jitter: true,
+	}
+	for i, s := range f.Apply(samples)[:2] {
+		if s.Coords.Latitude != decoy.Latitude || s.Coords.Longitude != decoy.Longitude {
+			t.Errorf("f.Apply(%#v)[%d].Coords == %#v, want decoy %#v", samples, i, s.Coords, decoy)
+		}
+	}
+
+	thin := doarama.PrivacyZone{
+		Polygon: []doarama.Point{
+			{Latitude: 46, Longitude: 12},
+			{Latitude: 47, Longitude: 12.9999999},
+			{Latitude: 48, Longitude: 14},
+			{Latitude: 47, Longitude: 13.0000001},
+		},
+	}
+	f = &doarama.PrivacyFilter{
+		Zones:  []doarama.PrivacyZone{thin},
+		Jitter: true,
+		Rand:   rand.New(rand.NewSource(1)),
+	}
+	if got, want := f.Apply(samples[:1]), []doarama.Sample{}; !reflect.DeepEqual(got, want) {
+		t.Errorf("f.Apply(%#v) with a thin polygon == %#v, want %#v", samples[:1], got, want)
+	}
+}
+
+func TestReadPrivacyZones(t *testing.T) {
+	for _, tc := range []struct {
+		s       string
+		wantErr bool
+	}{
+		{s: `[{"name": "home", "latitude": 47, "longitude": 13, "radius": 500}]`},
+		{s: `[]`, wantErr: true},
+		{s: `[{"name": "home", "latitude": 47, "longitude": 13}]`, wantErr: true},
+		{s: `[{"name": "work", "polygon": [{"latitude": 0, "longitude": 0}, {"latitude": 1, "longitude": 0}]}]`, wantErr: true},
+		{s: `[{"name": "home", "latitude": 47, "longitude": 13, "radius": 500, "decoy": {"latitude": 47.001, "longitude": 13}}]`},
+		{s: `[{"name": "home", "latitude": 47, "longitude": 13, "radius": 500, "decoy": {"latitude": 47.1, "longitude": 13}}]`, wantErr: true},
+	} {
+		if _, err := doarama.ReadPrivacyZones(strings.NewReader(tc.s)); (err != nil) != tc.wantErr {
+			t.Errorf("doarama.ReadPrivacyZones(%q) == ..., %v, want error %v", tc.s, err, tc.wantErr)
+		}
+	}
+}
@@ -0,0 +1,170 @@
+package doarama
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/twpayne/go-gpx"
+)
+
+// An ErrUnknownFormat is returned when the format of a GPS track cannot be
+// determined.
+type ErrUnknownFormat struct {
+	Filename string
+}
+
+// Error implements error.
+func (e *ErrUnknownFormat) Error() string {
+	return fmt.Sprintf("%s: unknown format", e.Filename)
+}
+
+// ReadGPX reads samples in GPX format from r.
+func ReadGPX(r io.Reader) ([]Sample, error) {
+	g, err := gpx.Read(r)
+	if err != nil {
+		return nil, err
+	}
+	var samples []Sample
+	for _, trk := range g.Trk {
+		for _, trkSeg := range trk.TrkSeg {
+			for _, trkPt := range trkSeg.TrkPt {
+				if trkPt.Time.IsZero() {
+					continue
+				}
+				samples = append(samples, Sample{
+					Time: NewTimestamp(trkPt.Time),
+					Coords: Coords{
+						Latitude:  trkPt.Lat,
+						Longitude: trkPt.Lon,
+						Altitude:  trkPt.Ele,
+					},
+				})
+			}
+		}
+	}
+	return samples, nil
+}
+
+// parseIGCDate parses the date from an IGC HFDTE record.
+func parseIGCDate(line string) (time.Time, error) {
+	s := strings.TrimPrefix(line[5:], "DATE:")
+	if len(s) < 6 {
+		return time.Time{}, fmt.Errorf("invalid date record %q", line)
+	}
+	return time.Parse("020106", s[:6])
+}
+
+// parseIGCAngle parses an IGC angle of the form DDMMmmmH or DDDMMmmmH.
+func parseIGCAngle(s string, degDigits int, hs string) (float64, error) {
+	d, err := strconv.Atoi(s[:degDigits])
+	if err != nil {
+		return 0, err
+	}
+	mm, err := strconv.Atoi(s[degDigits : degDigits+5])
+	if err != nil {
+		return 0, err
+	}
+	x := float64(d) + float64(mm)/60000
+	switch s[degDigits+5] {
+	case hs[0]:
+		return x, nil
+	case hs[1]:
+		return -x, nil
+	default:
+		return 0, fmt.Errorf("invalid hemisphere %q", s[degDigits+5])
+	}
+}
+
+// ReadIGC reads samples in IGC format from r. GNSS altitudes are used, falling
+// back to pressure altitudes when no GNSS altitude is recorded.
+func ReadIGC(r io.Reader) ([]Sample, error) {
+	var samples []Sample
+	var date time.Time
+	var prev time.Time
+	scanner := bufio.NewScanner(r)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimRight(scanner.Text(), "\r\n")
+		switch {
+		case strings.HasPrefix(line, "HFDTE"):
+			d, err := parseIGCDate(line)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %v", lineNumber, err)
+			}
+			date = d
+			prev = time.Time{}
+		case strings.HasPrefix(line, "B") && len(line) >= 35:
+			hour, err1 := strconv.Atoi(line[1:3])
+			minute, err2 := strconv.Atoi(line[3:5])
+			second, err3 := strconv.Atoi(line[5:7])
+			if err1 != nil || err2 != nil || err3 != nil {
+				return nil, fmt.Errorf("line %d: invalid time", lineNumber)
+			}
+			lat, err := parseIGCAngle(line[7:15], 2, "NS")
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %v", lineNumber, err)
+			}
+			lng, err := parseIGCAngle(line[15:24], 3, "EW")
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %v", lineNumber, err)
+			}
+			pressureAlt, err1 := strconv.Atoi(line[25:30])
+			gnssAlt, err2 := strconv.Atoi(line[30:35])
+			if err1 != nil || err2 != nil {
+				return nil, fmt.Errorf("line %d: invalid altitude", lineNumber)
+			}
+			alt := gnssAlt
+			if alt == 0 {
+				alt = pressureAlt
+			}
+			t := time.Date(date.Year(), date.Month(), date.Day(), hour, minute, second, 0, time.UTC)
+			if t.Before(prev) {
+				date = date.AddDate(0, 0, 1)
+				t = t.AddDate(0, 0, 1)
+			}
+			prev = t
+			samples = append(samples, Sample{
+				Time: NewTimestamp(t),
+				Coords: Coords{
+					Latitude:  lat,
+					Longitude: lng,
+					Altitude:  float64(alt),
+				},
+			})
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return samples, nil
+}
+
+// ReadSamples reads samples from r, using filename's extension to determine
+// the format.
+func ReadSamples(filename string, r io.Reader) ([]Sample, error) {
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".gpx":
+		return ReadGPX(r)
+	case ".igc":
+		return ReadIGC(r)
+	default:
+		return nil, &ErrUnknownFormat{Filename: filename}
+	}
+}
+
+// WriteSamples writes samples to w, using filename's extension to determine
+// the format.
+func WriteSamples(filename string, w io.Writer, samples []Sample) error {
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".gpx":
+		return WriteGPX(w, samples)
+	case ".igc":
+		return WriteIGC(w, samples)
+	default:
+		return &ErrUnknownFormat{Filename: filename}
+	}
+}
@@ -0,0 +1,78 @@
+package doarama_test
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/twpayne/go-doarama"
+)
+
+func TestReadIGC(t *testing.T) {
+	for _, tc := range []struct {
+		igc  string
+		want []doarama.Sample
+	}{
+		{
+			igc: "" +
+				"AXXXABC\r\n" +
+				"HFDTE050715\r\n" +
+				"B0930004747931N01302904EA0043000430\r\n" +
+				"B1115004748247N01306654EA0127200000\r\n",
+			want: []doarama.Sample{
+				{
+					Time: doarama.NewTimestamp(time.Date(2015, 7, 5, 9, 30, 0, 0, time.UTC)),
+					Coords: doarama.Coords{
+						Latitude:  47 + 47931.0/60000,
+						Longitude: 13 + 2904.0/60000,
+						Altitude:  430,
+					},
+				},
+				{
+					Time: doarama.NewTimestamp(time.Date(2015, 7, 5, 11, 15, 0, 0, time.UTC)),
+					Coords: doarama.Coords{
+						Latitude:  47 + 48247.0/60000,
+						Longitude: 13 + 6654.0/60000,
+						Altitude:  1272,
+					},
+				},
+			},
+		},
+		{
+			igc: "" +
+				"HFDTEDATE:311215,01\r\n" +
+				"B2359593300000S07000000WA0000000100\r\n" +
+				"B0000013300000S07000000WA0000000100\r\n",
+			want: []doarama.Sample{
+				{
+					Time: doarama.NewTimestamp(time.Date(2015, 12, 31, 23, 59, 59, 0, time.UTC)),
+					Coords: doarama.Coords{
+						Latitude:  -33,
+						Longitude: -70,
+						Altitude:  100,
+					},
+				},
+				{
+					Time: doarama.NewTimestamp(time.Date(2016, 1, 1, 0, 0, 1, 0, time.UTC)),
+					Coords: doarama.Coords{
+						Latitude:  -33,
+						Longitude: -70,
+						Altitude:  100,
+					},
+				},
+			},
+		},
+	} {
+		got, err := doarama.ReadIGC(strings.NewReader(tc.igc))
+		if err != nil || !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("doarama.ReadIGC(%q) == %#v, %v, want %#v, nil", tc.igc, got, err, tc.want)
+		}
+	}
+}
+
+func TestReadSamplesUnknownFormat(t *testing.T) {
+	if _, err := doarama.ReadSamples("track.kml", strings.NewReader("")); reflect.TypeOf(err) != reflect.TypeOf(&doarama.ErrUnknownFormat{}) {
+		t.Errorf("doarama.ReadSamples(%q, ...) == ..., %#v, want ..., %T", "track.kml", err, &doarama.ErrUnknownFormat{})
+	}
+}
@@ -0,0 +1,146 @@
+package doarama
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// rollbackAttempts is the number of attempts to delete each activity when
+// rolling back.
+const rollbackAttempts = 3
+
+// rollbackTimeout is the maximum time spent rolling back.
+const rollbackTimeout = time.Minute
+
+// rollbackRetryDelay is the delay before the first retry of a failed delete.
+var rollbackRetryDelay = time.Second
+
+// A ResourceCreator creates and deletes activities and creates
+// visualisations. *Client and the caches in package doaramacache implement
+// it.
+type ResourceCreator interface {
+	ActivityWithInfoCreator
+	CreateVisualisation(context.Context, []*Activity) (*Visualisation, error)
+	DeleteActivity(context.Context, *Activity) error
+}
+
+// An ErrRollback is returned when an operation failed and some of the
+// resources that it created could not be deleted.
+type ErrRollback struct {
+	Err       error
+	Leftovers []*Activity
+}
+
+// Error implements error.
+func (e *ErrRollback) Error() string {
+	ids := make([]string, len(e.Leftovers))
+	for i, a := range e.Leftovers {
+		ids[i] = fmt.Sprintf("%d", a.ID)
+	}
+	return fmt.Sprintf("%v (rollback failed, leftover activities: %s)", e.Err, strings.Join(ids, ", "))
+}
+
+// deleteWithRetries deletes activity with rc, retrying on failure. Activities
+// that do not exist are considered deleted.
+func deleteWithRetries(ctx context.Context, rc ResourceCreator, activity *Activity) error {
+	delay := rollbackRetryDelay
+	for attempt := 1; ; attempt++ {
+		err := rc.DeleteActivity(ctx, activity)
+		if err == nil || IsNotFound(err) {
+			return nil
+		}
+		if attempt >= rollbackAttempts {
+			return err
+		}
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		delay *= 2
+	}
+}
+
+// rollback deletes the activities that were created with rc after err.
+// Activities that were re-used rather than created are left alone, as other
+// visualisations may depend on them. It returns err if all created activities
+// were deleted, or an *ErrRollback otherwise. Rolling back continues even if
+// ctx is cancelled.
+func rollback(rc ResourceCreator, activities []*Activity, created []bool, err error) error {
+	ctx, cancel := context.WithTimeout(context.Background(), rollbackTimeout)
+	defer cancel()
+	var leftovers []*Activity
+	for i, a := range activities {
+		if a == nil || !created[i] {
+			continue
+		}
+		if deleteErr := deleteWithRetries(ctx, rc, a); deleteErr != nil {
+			leftovers = append(leftovers, a)
+		}
+	}
+	if leftovers != nil {
+		return &ErrRollback{
+			Err:       err,
+			Leftovers: leftovers,
+		}
+	}
+	return err
+}
+
+// CreateVisualisationFromTracks creates activities from uploads, with up to
+// concurrency uploads in parallel, and a visualisation of them with rc. If any
+// step fails, or ctx is cancelled, then every activity created is deleted.
+// If rc is a ReusingActivityCreator then re-used activities are not deleted.
+// If some activities cannot be deleted then the error is an *ErrRollback
+// listing them.
+func CreateVisualisationFromTracks(ctx context.Context, rc ResourceCreator, uploads []Upload, concurrency int) (*Visualisation, []*Activity, error) {
+	vs, activities, err := CreateVisualisationsFromTracks(ctx, rc, [][]Upload{uploads}, concurrency)
+	if err != nil {
+		return nil, nil, err
+	}
+	return vs[0], activities[0], nil
+}
+
+// CreateVisualisationsFromTracks creates one visualisation for each group of
+// uploads with rc, as CreateVisualisationFromTracks. It is all or nothing: if
+// any group fails, or ctx is cancelled, then every activity created for every
+// group is deleted, which also breaks the visualisations already created.
+// The indexes in an ErrUploads count the uploads of all groups in order.
+func CreateVisualisationsFromTracks(ctx context.Context, rc ResourceCreator, groups [][]Upload, concurrency int) ([]*Visualisation, [][]*Activity, error) {
+	var vs []*Visualisation
+	var groupActivities [][]*Activity
+	var activities []*Activity
+	var created []bool
+	for _, uploads := range groups {
+		offset := len(activities)
+		as, cs, err := createActivities(ctx, rc, uploads, concurrency)
+		activities = append(activities, as...)
+		created = append(created, cs...)
+		if errUploads, ok := err.(ErrUploads); ok {
+			for _, errUpload := range errUploads {
+				errUpload.Index += offset
+			}
+		}
+		if err == nil {
+			err = ctx.Err()
+		}
+		if err != nil {
+			return nil, nil, rollback(rc, activities, created, err)
+		}
+		v, err := rc.CreateVisualisation(ctx, as)
+		if err != nil {
+			return nil, nil, rollback(rc, activities, created, err)
+		}
+		vs = append(vs, v)
+		groupActivities = append(groupActivities, as)
+	}
+	return vs, groupActivities, nil
+}
+
+// CreateVisualisationFromTracks creates activities from uploads and a
+// visualisation of them, as the package-level CreateVisualisationFromTracks.
+func (c *Client) CreateVisualisationFromTracks(ctx context.Context, uploads []Upload, concurrency int) (*Visualisation, []*Activity, error) {
+	return CreateVisualisationFromTracks(ctx, c, uploads, concurrency)
+}
@@ -0,0 +1,142 @@
+package doarama
+
+import (
+	"errors"
+	"math"
+	"sort"
+	"time"
+)
+
+// ErrNoOverlap is returned when two tracks do not overlap in time.
+var ErrNoOverlap = errors.New("tracks do not overlap")
+
+// A TimeReference relates a time recorded by a logger to the actual time.
+type TimeReference struct {
+	Recorded time.Time
+	Actual   time.Time
+}
+
+// Shift returns a copy of samples with all times shifted by offset.
+func Shift(samples []Sample, offset time.Duration) []Sample {
+	result := make([]Sample, len(samples))
+	copy(result, samples)
+	dt := durationToTimestamp(offset)
+	for i := range result {
+		result[i].Time += dt
+	}
+	return result
+}
+
+// RepairTimeZone returns a copy of samples recorded with a logger set to local
+// time in loc instead of UTC.
+func RepairTimeZone(samples []Sample, loc *time.Location) []Sample {
+	result := make([]Sample, len(samples))
+	copy(result, samples)
+	for i := range result {
+		t := result[i].Time.Time()
+		local := time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), loc)
+		result[i].Time = NewTimestamp(local)
+	}
+	return result
+}
+
+// CorrectDrift returns a copy of samples with a linearly drifting clock
+// corrected so that the recorded times of r1 and r2 map to their actual
+// times.
+func CorrectDrift(samples []Sample, r1, r2 TimeReference) ([]Sample, error) {
+	if r1.Recorded.Equal(r2.Recorded) {
+		return nil, errors.New("time references must have different recorded times")
+	}
+	recorded1, actual1 := NewTimestamp(r1.Recorded), NewTimestamp(r1.Actual)
+	recorded2, actual2 := NewTimestamp(r2.Recorded), NewTimestamp(r2.Actual)
+	scale := float64(actual2-actual1) / float64(recorded2-recorded1)
+	result := make([]Sample, len(samples))
+	copy(result, samples)
+	for i := range result {
+		result[i].Time = actual1 + Timestamp(math.Round(scale*float64(result[i].Time-recorded1)))
+	}
+	return result, nil
+}
+
+// interpolatePosition returns the position of samples at t, interpolating
+// between samples no more than maxGap apart. samples must be sorted.
+func interpolatePosition(samples []Sample, t, maxGap Timestamp) (float64, float64, bool) {
+	i := sort.Search(len(samples), func(i int) bool {
+		return samples[i].Time >= t
+	})
+	if i < len(samples) && samples[i].Time == t {
+		return samples[i].Coords.Latitude, samples[i].Coords.Longitude, true
+	}
+	if i == 0 || i == len(samples) {
+		return 0, 0, false
+	}
+	s0, s1 := samples[i-1], samples[i]
+	if s1.Time-s0.Time > maxGap {
+		return 0, 0, false
+	}
+	f := float64(t-s0.Time) / float64(s1.Time-s0.Time)
+	lat := s0.Coords.Latitude + f*(s1.Coords.Latitude-s0.Coords.Latitude)
+	lng := s0.Coords.Longitude + f*(s1.Coords.Longitude-s0.Coords.Longitude)
+	return lat, lng, true
+}
+
+// minOverlap is the minimum number of samples that must overlap for an
+// offset to be considered.
+const minOverlap = 10
+
+// maxAlignSamples is the maximum number of samples used to align tracks.
+const maxAlignSamples = 500
+
+// alignmentCost returns the mean distance between samples shifted by offset
+// and reference.
+func alignmentCost(samples, reference []Sample, offset Timestamp) (float64, bool) {
+	stride := len(samples)/maxAlignSamples + 1
+	maxGap := durationToTimestamp(DefaultMergeMaxGap)
+	n := 0
+	sum := 0.0
+	for i := 0; i < len(samples); i += stride {
+		s := &samples[i]
+		lat, lng, ok := interpolatePosition(reference, s.Time+offset, maxGap)
+		if !ok {
+			continue
+		}
+		sum += distance(s.Coords.Latitude, s.Coords.Longitude, lat, lng)
+		n++
+	}
+	if n < minOverlap {
+		return 0, false
+	}
+	return sum / float64(n), true
+}
+
+// bestOffset returns the offset between lo and hi in steps of step that best
+// aligns samples with reference.
+func bestOffset(samples, reference []Sample, lo, hi, step Timestamp) (Timestamp, bool) {
+	best, bestCost, found := Timestamp(0), math.Inf(1), false
+	for offset := lo; offset <= hi; offset += step {
+		if cost, ok := alignmentCost(samples, reference, offset); ok && cost < bestCost {
+			best, bestCost, found = offset, cost, true
+		}
+	}
+	return best, found
+}
+
+// InferTimeOffset returns the offset, no larger than maxOffset, that should be
+// added to the times of samples to best align them with reference, a track
+// recorded by another pilot flying nearby with a correct clock.
+func InferTimeOffset(samples, reference []Sample, maxOffset time.Duration) (time.Duration, error) {
+	sorted := sortAndDedup(samples, 0)
+	sortedReference := sortAndDedup(reference, 0)
+	max := durationToTimestamp(maxOffset)
+	coarseStep := durationToTimestamp(time.Minute)
+	fineStep := durationToTimestamp(time.Second)
+	coarse, ok := bestOffset(sorted, sortedReference, -max, max, coarseStep)
+	if !ok {
+		return 0, ErrNoOverlap
+	}
+	fine, ok := bestOffset(sorted, sortedReference, coarse-coarseStep, coarse+coarseStep, fineStep)
+	if !ok {
+		return 0, ErrNoOverlap
+	}
+	return time.Duration(fine) * time.Millisecond, nil
+}
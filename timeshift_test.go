@@ -0,0 +1,73 @@
+package doarama_test
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/twpayne/go-doarama"
+)
+
+func TestShift(t *testing.T) {
+	t0 := time.Date(2015, 7, 5, 9, 30, 0, 0, time.UTC)
+	samples := []doarama.Sample{newSample(t0, 47, 13, 500)}
+	want := []doarama.Sample{newSample(t0.Add(-2*time.Hour), 47, 13, 500)}
+	if got := doarama.Shift(samples, -2*time.Hour); !reflect.DeepEqual(got, want) {
+		t.Errorf("doarama.Shift(%#v, -2h) == %#v, want %#v", samples, got, want)
+	}
+}
+
+func TestRepairTimeZone(t *testing.T) {
+	loc, err := time.LoadLocation("Europe/Zurich")
+	if err != nil {
+		t.Skip(err)
+	}
+	samples := []doarama.Sample{
+		newSample(time.Date(2015, 1, 5, 11, 30, 0, 0, time.UTC), 47, 13, 500),
+		newSample(time.Date(2015, 7, 5, 11, 30, 0, 0, time.UTC), 47, 13, 500),
+	}
+	want := []doarama.Sample{
+		newSample(time.Date(2015, 1, 5, 10, 30, 0, 0, time.UTC), 47, 13, 500),
+		newSample(time.Date(2015, 7, 5, 9, 30, 0, 0, time.UTC), 47, 13, 500),
+	}
+	if got := doarama.RepairTimeZone(samples, loc); !reflect.DeepEqual(got, want) {
+		t.Errorf("doarama.RepairTimeZone(%#v, %v) == %#v, want %#v", samples, loc, got, want)
+	}
+}
+
+func TestCorrectDrift(t *testing.T) {
+	t0 := time.Date(2015, 7, 5, 9, 0, 0, 0, time.UTC)
+	samples := []doarama.Sample{
+		newSample(t0, 47, 13, 500),
+		newSample(t0.Add(time.Hour), 47, 13, 500),
+		newSample(t0.Add(2*time.Hour), 47, 13, 500),
+	}
+	r1 := doarama.TimeReference{Recorded: t0, Actual: t0.Add(10 * time.Second)}
+	r2 := doarama.TimeReference{Recorded: t0.Add(2 * time.Hour), Actual: t0.Add(2*time.Hour + 30*time.Second)}
+	want := []doarama.Sample{
+		newSample(t0.Add(10*time.Second), 47, 13, 500),
+		newSample(t0.Add(time.Hour+20*time.Second), 47, 13, 500),
+		newSample(t0.Add(2*time.Hour+30*time.Second), 47, 13, 500),
+	}
+	if got, err := doarama.CorrectDrift(samples, r1, r2); err != nil || !reflect.DeepEqual(got, want) {
+		t.Errorf("doarama.CorrectDrift(%#v, %#v, %#v) == %#v, %v, want %#v, nil", samples, r1, r2, got, err, want)
+	}
+	if _, err := doarama.CorrectDrift(samples, r1, r1); err == nil {
+		t.Errorf("doarama.CorrectDrift(%#v, %#v, %#v) == ..., nil, want ..., non-nil", samples, r1, r1)
+	}
+}
+
+func TestInferTimeOffset(t *testing.T) {
+	t0 := time.Date(2015, 7, 5, 9, 0, 0, 0, time.UTC)
+	var reference []doarama.Sample
+	for i := 0; i < 3600; i += 2 {
+		reference = append(reference, newSample(t0.Add(time.Duration(i)*time.Second), 47+float64(i)*0.0001, 13, 500))
+	}
+	samples := doarama.Shift(reference, -37*time.Second)
+	if got, err := doarama.InferTimeOffset(samples, reference, time.Hour); err != nil || got != 37*time.Second {
+		t.Errorf("doarama.InferTimeOffset(...) == %v, %v, want %v, nil", got, err, 37*time.Second)
+	}
+	if _, err := doarama.InferTimeOffset(samples, doarama.Shift(reference, 3*time.Hour), time.Hour); err != doarama.ErrNoOverlap {
+		t.Errorf("doarama.InferTimeOffset(...) == ..., %v, want ..., %v", err, doarama.ErrNoOverlap)
+	}
+}
@@ -0,0 +1,345 @@
+package doarama
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// An OpenFunc opens a GPS track. It is called once for each attempt to
+// upload it.
+type OpenFunc func() (io.ReadCloser, error)
+
+// A ProgressFunc is called as the GPS track in filename is uploaded with the
+// number of bytes sent so far and the total number of bytes, or -1 if the
+// total is unknown.
+type ProgressFunc func(filename string, sent, total int64)
+
+// A nopSeekCloser is an io.ReadSeeker with a Close method that does nothing.
+type nopSeekCloser struct {
+	io.ReadSeeker
+}
+
+// Close implements io.Closer.
+func (nopSeekCloser) Close() error {
+	return nil
+}
+
+// A progressReader reports the progress of reads from r.
+type progressReader struct {
+	r        io.ReadCloser
+	filename string
+	sent     int64
+	total    int64
+	progress ProgressFunc
+}
+
+// Read implements io.Reader.
+func (r *progressReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if n > 0 {
+		r.sent += int64(n)
+		r.progress(r.filename, r.sent, r.total)
+	}
+	return n, err
+}
+
+// Close implements io.Closer. It closes r so that the HTTP client can stop
+// the writer of a request body that it will not read.
+func (r *progressReader) Close() error {
+	return r.r.Close()
+}
+
+// size returns the number of bytes remaining in r, or -1 if it is unknown.
+func size(r io.Reader) int64 {
+	switch r := r.(type) {
+	case interface{ Len() int }:
+		return int64(r.Len())
+	case io.Seeker:
+		current, err := r.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return -1
+		}
+		end, err := r.Seek(0, io.SeekEnd)
+		if err != nil {
+			return -1
+		}
+		if _, err := r.Seek(current, io.SeekStart); err != nil {
+			return -1
+		}
+		return end - current
+	default:
+		return -1
+	}
+}
+
+// retryable returns whether a failed upload should be retried. Only network
+// errors and responses with status 429 Too Many Requests or 5xx are retried.
+// Other errors, such as errors reading or filtering the GPS track, would fail
+// again.
+func retryable(ctx context.Context, err error) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	if e, ok := err.(Error); ok {
+		return e.HTTPStatusCode == http.StatusTooManyRequests || e.HTTPStatusCode >= 500
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
+
+// CreateActivityFunc creates a new activity from the GPS track returned by
+// open, as CreateActivity. open is called again for each retry.
+func (c *Client) CreateActivityFunc(ctx context.Context, filename string, open OpenFunc) (*Activity, error) {
+	for attempt := 0; ; attempt++ {
+		gpsTrack, err := open()
+		if err != nil {
+			return nil, err
+		}
+		activity, err := c.createActivityOnce(ctx, filename, gpsTrack)
+		gpsTrack.Close()
+		if err == nil || attempt >= c.maxRetries || !retryable(ctx, err) {
+			return activity, err
+		}
+		select {
+		case <-time.After(c.retryDelay << uint(attempt)):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// createActivityOnce makes a single attempt to upload gpsTrack. The
+// multipart body is streamed through a pipe, with its length set if the
+// length of gpsTrack is known and it is not filtered. It does not return until
+// it has stopped reading gpsTrack, so gpsTrack can be re-used for a retry.
+// It returns an *ErrPrivacyUnsupported before making any request if the
+// privacy filter cannot be applied to gpsTrack.
+func (c *Client) createActivityOnce(ctx context.Context, filename string, gpsTrack io.Reader) (*Activity, error) {
+	if err := c.privacyFilter.supports(filename); err != nil {
+		return nil, err
+	}
+	var b bytes.Buffer
+	w := multipart.NewWriter(&b)
+	if _, err := w.CreateFormFile("gps_track", filepath.Base(filename)); err != nil {
+		return nil, err
+	}
+	header := append([]byte(nil), b.Bytes()...)
+	b.Reset()
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	trailer := b.Bytes()
+	contentLength := int64(-1)
+	if !c.privacyFilter.active() {
+		if n := size(gpsTrack); n >= 0 {
+			contentLength = int64(len(header)) + n + int64(len(trailer))
+		}
+	}
+	pr, pw := io.Pipe()
+	done := make(chan struct{})
+	var writeErr error
+	go func() {
+		defer close(done)
+		writeErr = c.writeGPSTrack(pw, header, filename, gpsTrack, trailer)
+		if writeErr == io.EOF {
+			// Closing the pipe with io.EOF would end the body early
+			// without an error.
+			pw.CloseWithError(io.ErrUnexpectedEOF)
+		} else {
+			pw.CloseWithError(writeErr)
+		}
+	}()
+	stop := func() {
+		pr.Close()
+		<-done
+	}
+	defer stop()
+	var body io.ReadCloser = pr
+	if c.progress != nil {
+		body = &progressReader{
+			r:        pr,
+			filename: filename,
+			total:    contentLength,
+			progress: c.progress,
+		}
+	}
+	req, err := c.newRequest("POST", c.apiURL+"/activity", body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", w.FormDataContentType())
+	if contentLength >= 0 {
+		req.ContentLength = contentLength
+	}
+	data := struct {
+		ID int `json:"id"`
+	}{}
+	if err := c.doRequest(ctx, req, &data); err != nil {
+		// The HTTP client reports errors reading the body as transport
+		// errors. Return the writer's own error instead, unless it only
+		// failed because the request stopped reading the body.
+		stop()
+		if writeErr != nil && writeErr != io.ErrClosedPipe {
+			return nil, writeErr
+		}
+		return nil, err
+	}
+	return &Activity{
+		Client: c,
+		ID:     data.ID,
+	}, nil
+}
+
+// writeGPSTrack writes the multipart body to upload gpsTrack, between header
+// and trailer, to w, applying any privacy filter.
+func (c *Client) writeGPSTrack(w io.Writer, header []byte, filename string, gpsTrack io.Reader, trailer []byte) error {
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+	if c.privacyFilter.active() {
+		if err := c.privacyFilter.applyTrack(filename, w, gpsTrack); err != nil {
+			return err
+		}
+	} else if _, err := io.Copy(w, gpsTrack); err != nil {
+		return err
+	}
+	_, err := w.Write(trailer)
+	return err
+}
+
+// An Upload is a GPS track to upload with its activity info. The GPS track is
+// read from GPSTrack or, if Open is set, from the reader returned by Open,
+// which is closed after the upload.
+type Upload struct {
+	Filename     string
+	GPSTrack     io.Reader
+	Open         OpenFunc
+	ActivityInfo *ActivityInfo
+}
+
+// An ActivityWithInfoCreator creates activities with activity info. *Client
+// and the caches in package doaramacache implement it.
+type ActivityWithInfoCreator interface {
+	CreateActivityWithInfo(context.Context, string, io.Reader, *ActivityInfo) (*Activity, error)
+}
+
+// A ReusingActivityCreator is an ActivityWithInfoCreator that may return an
+// existing activity rather than creating a new one. The caches in package
+// doaramacache implement it.
+type ReusingActivityCreator interface {
+	ActivityWithInfoCreator
+	// CreateOrReuseActivityWithInfo returns an activity, as
+	// CreateActivityWithInfo, and whether it was newly created.
+	CreateOrReuseActivityWithInfo(context.Context, string, io.Reader, *ActivityInfo) (*Activity, bool, error)
+}
+
+// An ErrUpload is an error uploading a single GPS track.
+type ErrUpload struct {
+	Index    int
+	Filename string
+	Err      error
+}
+
+// Error implements error.
+func (e *ErrUpload) Error() string {
+	return fmt.Sprintf("%s: %v", e.Filename, e.Err)
+}
+
+// An ErrUploads is returned when one or more uploads fail.
+type ErrUploads []*ErrUpload
+
+// Error implements error.
+func (e ErrUploads) Error() string {
+	ss := make([]string, len(e))
+	for i, err := range e {
+		ss[i] = err.Error()
+	}
+	return strings.Join(ss, "; ")
+}
+
+// createActivity creates an activity from u with ac, and returns whether it
+// was newly created.
+func (u *Upload) createActivity(ctx context.Context, ac ActivityWithInfoCreator) (*Activity, bool, error) {
+	gpsTrack := u.GPSTrack
+	if u.Open != nil {
+		rc, err := u.Open()
+		if err != nil {
+			return nil, false, err
+		}
+		defer rc.Close()
+		gpsTrack = rc
+	}
+	if rac, ok := ac.(ReusingActivityCreator); ok {
+		return rac.CreateOrReuseActivityWithInfo(ctx, u.Filename, gpsTrack, u.ActivityInfo)
+	}
+	activity, err := ac.CreateActivityWithInfo(ctx, u.Filename, gpsTrack, u.ActivityInfo)
+	return activity, activity != nil, err
+}
+
+// CreateActivities creates activities from uploads with ac, with up to
+// concurrency uploads in parallel. The returned activities are in the same
+// order as uploads. Failed uploads usually have nil activities, but an
+// activity is returned if it was created and a later step failed, so that the
+// caller can delete it. If any uploads fail then the error is an ErrUploads,
+// in the same order as uploads.
+func CreateActivities(ctx context.Context, ac ActivityWithInfoCreator, uploads []Upload, concurrency int) ([]*Activity, error) {
+	activities, _, err := createActivities(ctx, ac, uploads, concurrency)
+	return activities, err
+}
+
+// createActivities creates activities from uploads, as CreateActivities, and
+// also returns whether each activity was newly created rather than re-used.
+func createActivities(ctx context.Context, ac ActivityWithInfoCreator, uploads []Upload, concurrency int) ([]*Activity, []bool, error) {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	activities := make([]*Activity, len(uploads))
+	created := make([]bool, len(uploads))
+	errs := make([]error, len(uploads))
+	indexes := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency && i < len(uploads); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				activities[i], created[i], errs[i] = uploads[i].createActivity(ctx, ac)
+			}
+		}()
+	}
+	for i := range uploads {
+		indexes <- i
+	}
+	close(indexes)
+	wg.Wait()
+	var errUploads ErrUploads
+	for i, err := range errs {
+		if err != nil {
+			errUploads = append(errUploads, &ErrUpload{
+				Index:    i,
+				Filename: uploads[i].Filename,
+				Err:      err,
+			})
+		}
+	}
+	if errUploads != nil {
+		return activities, created, errUploads
+	}
+	return activities, created, nil
+}
+
+// CreateActivities creates activities from uploads, with up to concurrency
+// uploads in parallel, as the package-level CreateActivities.
+func (c *Client) CreateActivities(ctx context.Context, uploads []Upload, concurrency int) ([]*Activity, error) {
+	return CreateActivities(ctx, c, uploads, concurrency)
+}
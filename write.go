@@ -48,6 +48,13 @@ func dmmh(x float64, hs string) (d int, mm int, h uint8) {
 	return
 }
 
+// formatIGCPosition returns lat, lng as in an IGC B record.
+func formatIGCPosition(lat, lng float64) string {
+	latDeg, latMMin, latHemi := dmmh(lat, "NS")
+	lngDeg, lngMMin, lngHemi := dmmh(lng, "EW")
+	return fmt.Sprintf("%02d%05d%c%03d%05d%c", latDeg, latMMin, latHemi, lngDeg, lngMMin, lngHemi)
+}
+
 // WriteIGC writes samples to w in IGC format.
 func WriteIGC(w io.Writer, samples []Sample) error {
 	var date time.Time